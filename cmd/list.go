@@ -0,0 +1,35 @@
+/*
+Copyright © 2023 Soroush Taheri soroushtgh@gmail.com
+*/
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	core "github.com/soroushtaheri/pg_pack/pkg"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the contents of a compressed package",
+	Long: `List prints the table of contents of a compressed '.pack' package:
+every entry along with its type, the object it concerns, the entries
+it depends on and the size of its compressed segment.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := core.ListPackage(cmdInput, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringVarP(&cmdInput, "input", "i", "", "Package file to list ('.pack')")
+
+	listCmd.MarkFlagFilename("input")
+	listCmd.MarkFlagRequired("input")
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 Soroush Taheri soroushtgh@gmail.com
+*/
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	core "github.com/soroushtaheri/pg_pack/pkg"
+)
+
+var cmdInput string
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a package created by pg_pack into a database",
+	Long: `Restore replays a package created by pg_pack against the target database.
+Both plain '.sql' packages and compressed '.pack' packages are supported.
+The whole package is restored inside a single transaction.
+Compressed packages can be restored partially with '--schema', '--table',
+'--exclude-table', '--data-only' and '--schema-only'. Objects the selected
+ones depend on (e.g. their schema, types or extensions) are not restored
+and must already exist in the target database. Foreign keys of the
+database referencing a restored table are dropped while it is restored
+and added back afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		promptPassword()
+
+		m, err := core.NewManager(nil, &cmdCreds, &cmdOpts)
+
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+
+		if err := m.Restore(cmdInput); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	addConnectionFlags(restoreCmd)
+
+	restoreCmd.Flags().StringVarP(&cmdInput, "input", "i", "", "Package file to restore ('.sql' or '.pack')")
+
+	restoreCmd.Flags().StringToStringVar(&cmdOpts.RenameSchemas, "rename-schema", nil, "Restore schemas under new names, given as 'old=new' pairs (e.g. --rename-schema public=staging)")
+
+	restoreCmd.Flags().StringArrayVarP(&cmdOpts.Schemas, "schema", "n", nil, "Only restore objects of schemas matching this pattern (repeatable). Patterns are globs (e.g. 'app_*') or regular expressions enclosed in slashes (e.g. '/^app_/')")
+	restoreCmd.Flags().StringArrayVarP(&cmdOpts.Tables, "table", "t", nil, "Only restore tables matching this pattern, given as 'table' or 'schema.table', along with their constraints, indexes and dependent views (repeatable)")
+	restoreCmd.Flags().StringArrayVarP(&cmdOpts.ExcludeTables, "exclude-table", "T", nil, "Do not restore tables matching this pattern (repeatable)")
+	restoreCmd.Flags().BoolVarP(&cmdOpts.DataOnly, "data-only", "D", false, "Only restore data records")
+	restoreCmd.Flags().BoolVar(&cmdOpts.SchemaOnly, "schema-only", false, "Only restore schemas (exclude data records)")
+
+	restoreCmd.MarkFlagFilename("input")
+	restoreCmd.MarkFlagRequired("input")
+}
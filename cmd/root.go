@@ -11,7 +11,6 @@ import (
 
 	"github.com/spf13/cobra"
 
-	_ "github.com/lib/pq"
 	core "github.com/soroushtaheri/pg_pack/pkg"
 	"golang.org/x/term"
 )
@@ -26,16 +25,12 @@ var rootCmd = &cobra.Command{
 	Long: `pg_pack is a command-line tool for quickly packing PostgreSQL databases,
 outperforming traditional methods like pg_dump, enabling faster backups and migrations`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if cmdCreds.Password == "" {
-			fmt.Printf("Password for user %s: ", cmdCreds.Username)
-			passB, err := term.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				os.Exit(1)
-			}
-			cmdCreds.Password = string(passB)
-			fmt.Println()
+		if cmd.Flags().Changed("compress-algo") || cmd.Flags().Changed("compress-level") {
+			cmdOpts.Compress = true
 		}
 
+		promptPassword()
+
 		m, err := core.NewManager(&cmdOutput, &cmdCreds, &cmdOpts)
 
 		if err != nil {
@@ -49,6 +44,35 @@ outperforming traditional methods like pg_dump, enabling faster backups and migr
 	},
 }
 
+// promptPassword asks for the database password on the terminal
+// if it was not provided through the '--password' flag.
+func promptPassword() {
+	if cmdCreds.Password != "" {
+		return
+	}
+
+	fmt.Printf("Password for user %s: ", cmdCreds.Username)
+	passB, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		os.Exit(1)
+	}
+	cmdCreds.Password = string(passB)
+	fmt.Println()
+}
+
+// addConnectionFlags adds the flags describing the database connection to
+// a command. Commands working on package files alone (e.g. 'list') go without.
+func addConnectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&cmdCreds.Host, "host", "localhost", "PostgreSQL host")
+	cmd.Flags().Int16VarP(&cmdCreds.Port, "port", "p", 5432, "PostgreSQL port")
+	cmd.Flags().StringVarP(&cmdCreds.Username, "user", "u", "postgres", "PostgreSQL username")
+	cmd.Flags().StringVar(&cmdCreds.Password, "password", "", "PostgreSQL password")
+	cmd.Flags().StringVarP(&cmdCreds.Database, "database", "d", "", "PostgreSQL database")
+	cmd.Flags().BoolVarP(&cmdCreds.SSL, "ssl", "s", false, "Enable 'sslmode' when connecting to the database")
+
+	cmd.MarkFlagRequired("database")
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -59,18 +83,30 @@ func Execute() {
 func init() {
 	rootCmd.Flags().StringVarP(&cmdOutput, "output", "o", "", "Output file")
 
-	rootCmd.Flags().StringVar(&cmdCreds.Host, "host", "localhost", "PostgreSQL host")
-	rootCmd.Flags().Int16VarP(&cmdCreds.Port, "port", "p", 5432, "PostgreSQL port")
-	rootCmd.Flags().StringVarP(&cmdCreds.Username, "user", "u", "postgres", "PostgreSQL username")
-	rootCmd.Flags().StringVar(&cmdCreds.Password, "password", "", "PostgreSQL password")
-	rootCmd.Flags().StringVarP(&cmdCreds.Database, "database", "d", "", "PostgreSQL database")
-	rootCmd.Flags().BoolVarP(&cmdCreds.SSL, "ssl", "s", false, "Enable 'sslmode' when connecting to the database")
+	addConnectionFlags(rootCmd)
 
 	rootCmd.Flags().BoolVarP(&cmdOpts.Compress, "compress", "c", false, "Compress the final package. If enabled, the final file format will be '.pack' otherwise the standard '.sql'")
+	rootCmd.Flags().StringVar(&cmdOpts.CompressAlgorithm, "compress-algo", "brotli", "Compression algorithm of the package. Must be one of 'brotli', 'zstd', 'gzip', 'lz4' or 'none'. Implies '--compress' unless 'none'")
+	rootCmd.Flags().IntVar(&cmdOpts.CompressLevel, "compress-level", 0, "Compression level (brotli: 1-11, zstd: 1-22, gzip: 1-9, lz4: 1-9). Defaults to the algorithm's default level. Implies '--compress'")
 	rootCmd.Flags().BoolVarP(&cmdOpts.DataOnly, "data-only", "D", false, "Only pack tables' data records (exclude schemas)")
+	rootCmd.Flags().BoolVar(&cmdOpts.SchemaOnly, "schema-only", false, "Only pack schemas (exclude tables' data records)")
+	rootCmd.Flags().StringArrayVarP(&cmdOpts.Schemas, "schema", "n", nil, "Only pack schemas matching this pattern (repeatable). Patterns are globs (e.g. 'app_*') or regular expressions enclosed in slashes (e.g. '/^app_/')")
+	rootCmd.Flags().StringArrayVarP(&cmdOpts.ExcludeSchemas, "exclude-schema", "N", nil, "Do not pack schemas matching this pattern (repeatable)")
+	rootCmd.Flags().StringArrayVarP(&cmdOpts.Tables, "table", "t", nil, "Only pack tables, views and sequences matching this pattern, given as 'table' or 'schema.table', along with the objects they depend on (repeatable)")
+	rootCmd.Flags().StringArrayVarP(&cmdOpts.ExcludeTables, "exclude-table", "T", nil, "Do not pack tables, views and sequences matching this pattern (repeatable)")
+	rootCmd.Flags().StringArrayVar(&cmdOpts.ExcludeTableData, "exclude-table-data", nil, "Pack the definition of tables matching this pattern but not their data records (repeatable)")
+	rootCmd.Flags().StringArrayVar(&cmdOpts.RowFilters, "where", nil, "Only pack the data records of a table satisfying a predicate, given as 'table: predicate' (e.g. --where \"orders: created_at > now() - interval '30 days'\") (repeatable)")
+	rootCmd.Flags().StringVar(&cmdOpts.RowFiltersFile, "where-file", "", "File holding row filters as 'table: predicate', one per line")
+	rootCmd.Flags().StringVar(&cmdOpts.SubsetTable, "subset", "", "Only pack the data records of this table selected by '--subset-where' and '--subset-size', along with the records of other tables they reference through foreign keys. Other tables are packed without data records")
+	rootCmd.Flags().StringVar(&cmdOpts.SubsetFilter, "subset-where", "", "Predicate selecting the records of the subset table (e.g. \"created_at > now() - interval '7 days'\")")
+	rootCmd.Flags().IntVar(&cmdOpts.SubsetSize, "subset-size", 0, "Maximum number of records of the subset table to select. Records they reference in the same table are packed on top of them")
+	rootCmd.Flags().StringVar(&cmdOpts.MaskingRulesFile, "mask-rules", "", "File of masking rules as 'schema.table.column: transformer', one per line. Transformers: null, fixed <value>, hash, email, name, redact [n], token")
+	rootCmd.Flags().StringVar(&cmdOpts.MaskingKey, "mask-key", "", "Secret key the 'hash', 'email', 'name' and 'token' masking transformers derive their output from, required by them")
+	rootCmd.Flags().StringToStringVar(&cmdOpts.RenameSchemas, "rename-schema", nil, "Rename schemas in the package, given as 'old=new' pairs (e.g. --rename-schema public=staging). Schema names qualifying packed objects are rewritten in the packed statements, except in string literals and function bodies")
+	rootCmd.Flags().BoolVar(&cmdOpts.RefreshMaterializedViews, "refresh-matviews", false, "Refresh materialized views once the data records are loaded")
+	rootCmd.Flags().IntVarP(&cmdOpts.Jobs, "jobs", "j", 1, "Number of tables whose data records are packed in parallel, each on its own connection sharing the same snapshot. Tables packed ahead of the package are spooled to temporary files next to it, compressed like the package, up to twice as many tables as jobs")
 	rootCmd.Flags().StringVar(&cmdOpts.RecordMode, "record-mode", "copy", "How should pg_pack write data records in the package file. Must be either 'INSERT' (safer) or 'COPY' (faster & lighter). Defaults to 'COPY'")
 
 	rootCmd.MarkFlagFilename("output")
 	rootCmd.MarkFlagRequired("output")
-	rootCmd.MarkFlagRequired("database")
 }
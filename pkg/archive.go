@@ -0,0 +1,446 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Compressed packages are archives laid out as follows:
+//
+//	header   packMagic, format version (1 byte), codec ID (1 byte)
+//	segments the content of every entry, each compressed on its own
+//	TOC      the table of contents, a JSON array of tocEntry
+//	trailer  offset of the TOC (8 bytes, big-endian), packMagic
+//
+// Since every entry is compressed separately, a single entry can be read
+// without decompressing the ones preceding it. Restoring the whole archive
+// amounts to replaying the entries in the order of the TOC.
+
+// tocEntry describes an entry of an archive: a piece of the package
+// concerning a single object, such as the definition or the data of a table.
+type tocEntry struct {
+	ID       int    `json:"id"`
+	Type     string `json:"type"`
+	Schema   string `json:"schema,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Deps     []int  `json:"deps,omitempty"` // IDs of the entries this one depends on
+	Offset   int64  `json:"offset"`         // Offset of the compressed segment in the archive
+	Length   int64  `json:"length"`         // Length of the compressed segment
+	Checksum uint32 `json:"checksum"`       // CRC-32 (IEEE) of the compressed segment
+}
+
+// packageWriter writes a package to the output file. Plain packages are
+// written as-is through a buffer. Compressed packages are written as
+// archives, where everything written between beginEntry and endEntry is
+// stored as an entry of its own. Outside of entries, only comments are
+// written; they are kept in plain packages and left out of archives, which
+// reject anything else.
+// Close must be called once the package is complete.
+type packageWriter struct {
+	w       io.Writer
+	buffer  *bufio.Writer
+	renames map[string]string          // Schema renames applied to the entries, see writeEntry
+	packed  map[string]map[string]bool // Names of the packed objects by schema, see writeEntry
+
+	// Archives only
+	archive    bool
+	codec      compressionCodec
+	level      int
+	offset     int64 // Bytes written to w so far
+	entries    []tocEntry
+	objectIDs  map[objectKey]int // IDs of the entries defining the packed objects
+	entry      *tocEntry         // Entry being written, if any
+	compressor io.WriteCloser
+	checksum   hash.Hash32
+}
+
+// newPackageWriter returns a packageWriter writing to w. Unless the package
+// is plain, the archive header is written to w right away.
+func (m Manager) newPackageWriter(w io.Writer) (*packageWriter, error) {
+	if !m.Options.Compress {
+		return &packageWriter{w: w, buffer: bufio.NewWriterSize(w, 64*1024), renames: m.Options.RenameSchemas}, nil
+	}
+
+	codec, err := getCompressionCodec(m.Options.CompressAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	level := m.Options.CompressLevel
+	if level == 0 {
+		level = codec.defaultLevel
+	}
+
+	p := &packageWriter{
+		w:         w,
+		renames:   m.Options.RenameSchemas,
+		archive:   true,
+		codec:     codec,
+		level:     level,
+		objectIDs: make(map[objectKey]int),
+		checksum:  crc32.NewIEEE(),
+	}
+
+	n, err := w.Write(append([]byte(packMagic), packFormatVersion, codec.id))
+	p.offset += int64(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *packageWriter) Write(b []byte) (int, error) {
+	if !p.archive {
+		return p.buffer.Write(b)
+	}
+
+	if p.entry == nil {
+		// Comments between entries are left out, but statements would be lost
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+				return 0, fmt.Errorf("cannot write %q outside of an entry", line)
+			}
+		}
+		return len(b), nil
+	}
+
+	return p.buffer.Write(b)
+}
+
+// segmentWriter receives the compressed segment of the current entry.
+type segmentWriter struct {
+	p *packageWriter
+}
+
+func (s segmentWriter) Write(b []byte) (int, error) {
+	n, err := s.p.w.Write(b)
+	s.p.checksum.Write(b[:n])
+	s.p.offset += int64(n)
+	return n, err
+}
+
+// beginEntry starts an entry about the given object. If the object has a
+// key, later entries may depend on the entry through it. Dependencies on
+// objects without an entry in the archive are left out of the TOC.
+// Plain packages have no entries, so beginEntry is a no-op for them.
+func (p *packageWriter) beginEntry(object packObject) error {
+	if !p.archive {
+		return nil
+	}
+
+	if p.entry != nil {
+		return fmt.Errorf("entry %d is not finished", p.entry.ID)
+	}
+
+	entry := tocEntry{
+		ID:     len(p.entries) + 1,
+		Type:   object.Type,
+		Schema: renamedSchema(object.Schema, p.renames),
+		Name:   object.Name,
+		Offset: p.offset,
+	}
+	if object.Type == "SCHEMA" {
+		entry.Name = renamedSchema(object.Name, p.renames)
+	}
+
+	for _, dep := range object.Deps {
+		if id, ok := p.objectIDs[dep]; ok {
+			entry.Deps = append(entry.Deps, id)
+		}
+	}
+
+	if object.Key != (objectKey{}) {
+		p.objectIDs[object.Key] = entry.ID
+	}
+
+	compressor, err := p.codec.newWriter(segmentWriter{p}, p.level)
+	if err != nil {
+		return fmt.Errorf("cannot initialize %s compression: %v", p.codec.name, err)
+	}
+
+	p.checksum.Reset()
+	p.compressor = compressor
+	if p.buffer == nil {
+		p.buffer = bufio.NewWriterSize(compressor, 64*1024)
+	} else {
+		p.buffer.Reset(compressor)
+	}
+	p.entry = &entry
+
+	return nil
+}
+
+// endEntry finishes the current entry and records it in the TOC.
+func (p *packageWriter) endEntry() error {
+	if !p.archive {
+		return nil
+	}
+
+	if err := p.buffer.Flush(); err != nil {
+		return err
+	}
+
+	if err := p.compressor.Close(); err != nil {
+		return err
+	}
+
+	p.entry.Length = p.offset - p.entry.Offset
+	p.entry.Checksum = p.checksum.Sum32()
+	p.entries = append(p.entries, *p.entry)
+	p.entry = nil
+
+	return nil
+}
+
+// writeEntry writes an entry about the given object holding content.
+// Archives leave entries without any statement out. The schemas renamed by
+// the options are renamed in the names of packed objects content references,
+// see renameSchemaReferences.
+func (p *packageWriter) writeEntry(object packObject, content string) error {
+	if p.archive && strings.TrimSpace(content) == "" {
+		return nil
+	}
+
+	if err := p.beginEntry(object); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(p, renameSchemaReferences(content, p.renames, p.packed)); err != nil {
+		return err
+	}
+
+	return p.endEntry()
+}
+
+// Close flushes the buffered data and, for archives, writes the TOC.
+// It does not close the underlying writer.
+func (p *packageWriter) Close() error {
+	if !p.archive {
+		return p.buffer.Flush()
+	}
+
+	if p.entry != nil {
+		return fmt.Errorf("entry %d is not finished", p.entry.ID)
+	}
+
+	toc, err := json.Marshal(p.entries)
+	if err != nil {
+		return err
+	}
+
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(p.offset))
+	trailer = append(trailer, packMagic...)
+
+	if _, err := p.w.Write(toc); err != nil {
+		return err
+	}
+
+	_, err = p.w.Write(trailer)
+	return err
+}
+
+// packArchive is a compressed package opened for reading.
+type packArchive struct {
+	file    *os.File
+	codec   compressionCodec
+	entries []tocEntry
+}
+
+// openArchive reads the header and the TOC of the archive stored in f.
+func openArchive(f *os.File) (*packArchive, error) {
+	header := make([]byte, len(packMagic)+2)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:len(packMagic)]) != packMagic {
+		return nil, fmt.Errorf("not a compressed package")
+	}
+
+	if version := header[len(packMagic)]; version != packFormatVersion {
+		return nil, fmt.Errorf("unsupported package format version %d", version)
+	}
+
+	codec, err := getCompressionCodecByID(header[len(packMagic)+1])
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, 8+len(packMagic))
+	trailerOffset := info.Size() - int64(len(trailer))
+	if trailerOffset < int64(len(header)) {
+		return nil, fmt.Errorf("package is truncated")
+	}
+	if _, err := f.ReadAt(trailer, trailerOffset); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != packMagic {
+		return nil, fmt.Errorf("package is truncated")
+	}
+
+	tocOffset := int64(binary.BigEndian.Uint64(trailer))
+	if tocOffset < int64(len(header)) || tocOffset > trailerOffset {
+		return nil, fmt.Errorf("package is corrupted: invalid TOC offset")
+	}
+
+	toc := make([]byte, trailerOffset-tocOffset)
+	if _, err := f.ReadAt(toc, tocOffset); err != nil {
+		return nil, err
+	}
+
+	archive := &packArchive{file: f, codec: codec}
+	if err := json.Unmarshal(toc, &archive.entries); err != nil {
+		return nil, fmt.Errorf("package is corrupted: invalid TOC: %v", err)
+	}
+
+	return archive, nil
+}
+
+// openEntry returns a reader over the decompressed content of an entry.
+// The checksum of the entry is verified once the reader reaches its end.
+func (a *packArchive) openEntry(entry tocEntry) (io.ReadCloser, error) {
+	segment := &checksumReader{
+		r:        io.NewSectionReader(a.file, entry.Offset, entry.Length),
+		checksum: crc32.NewIEEE(),
+	}
+
+	decompressor, err := a.codec.newReader(segment)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read entry %d: %v", entry.ID, err)
+	}
+
+	return &entryReader{entry: entry, decompressor: decompressor, segment: segment}, nil
+}
+
+// script returns a reader over the concatenated content of the given entries.
+func (a *packArchive) script(entries []tocEntry) io.Reader {
+	return &scriptConcatReader{archive: a, entries: entries}
+}
+
+// checksumReader computes the checksum of everything read through it.
+type checksumReader struct {
+	r        io.Reader
+	checksum hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.checksum.Write(p[:n])
+	return n, err
+}
+
+// entryReader decompresses an entry and verifies its checksum at the end.
+type entryReader struct {
+	entry        tocEntry
+	decompressor io.ReadCloser
+	segment      *checksumReader
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	n, err := e.decompressor.Read(p)
+	if err == nil {
+		return n, nil
+	}
+
+	// Account for any bytes the decompressor left unread. A corrupted
+	// segment may as well make the decompressor fail before its end.
+	if _, drainErr := io.Copy(io.Discard, e.segment); drainErr != nil {
+		return n, drainErr
+	}
+
+	if e.segment.checksum.Sum32() != e.entry.Checksum {
+		return n, fmt.Errorf("entry %d (%s) is corrupted: checksum mismatch", e.entry.ID, strings.TrimSpace(e.entry.Type+" "+entryObjectName(e.entry)))
+	}
+
+	return n, err
+}
+
+func (e *entryReader) Close() error {
+	return e.decompressor.Close()
+}
+
+// scriptConcatReader reads entries one after another.
+type scriptConcatReader struct {
+	archive *packArchive
+	entries []tocEntry
+	current io.ReadCloser
+}
+
+func (s *scriptConcatReader) Read(p []byte) (int, error) {
+	for {
+		if s.current == nil {
+			if len(s.entries) == 0 {
+				return 0, io.EOF
+			}
+
+			entry, err := s.archive.openEntry(s.entries[0])
+			if err != nil {
+				return 0, err
+			}
+			s.current, s.entries = entry, s.entries[1:]
+		}
+
+		n, err := s.current.Read(p)
+		if err == io.EOF {
+			s.current.Close()
+			s.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+// entryObjectName returns the qualified name of the object of an entry.
+func entryObjectName(entry tocEntry) string {
+	if entry.Schema == "" {
+		return entry.Name
+	}
+	return entry.Schema + "." + entry.Name
+}
+
+// ListPackage writes the table of contents of a compressed package to w.
+func ListPackage(inputFilename string, w io.Writer) error {
+	inputFile, err := os.Open(inputFilename)
+	if err != nil {
+		return fmt.Errorf("cannot open input file: %v", err)
+	}
+	defer inputFile.Close()
+
+	archive, err := openArchive(inputFile)
+	if err != nil {
+		return fmt.Errorf("cannot read package: %v", err)
+	}
+
+	fmt.Fprintf(w, "; Package format version: %d\n", packFormatVersion)
+	fmt.Fprintf(w, "; Compression: %s\n", archive.codec.name)
+	fmt.Fprintf(w, "; Entries: %d\n;\n", len(archive.entries))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tSCHEMA\tNAME\tDEPENDENCIES\tSIZE\tCHECKSUM")
+	for _, entry := range archive.entries {
+		deps := make([]string, 0, len(entry.Deps))
+		for _, dep := range entry.Deps {
+			deps = append(deps, strconv.Itoa(dep))
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%08x\n",
+			entry.ID, entry.Type, entry.Schema, entry.Name, strings.Join(deps, ","), entry.Length, entry.Checksum)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestArchive writes an archive with a schema, a table depending on it
+// and the data of the table, compressed with the given codec.
+func writeTestArchive(t *testing.T, algorithm string) (filename string, contents []string) {
+	t.Helper()
+
+	filename = filepath.Join(t.TempDir(), "test.pack")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m := Manager{Options: &Options{Compress: true, CompressAlgorithm: algorithm}}
+	w, err := m.newPackageWriter(f)
+	if err != nil {
+		t.Fatalf("newPackageWriter: %v", err)
+	}
+
+	var records strings.Builder
+	records.WriteString("COPY app.t (id, name) FROM stdin;\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&records, "%d\tname %d\n", i, i*7919%1000)
+	}
+	records.WriteString("\\.\n")
+
+	schema := packObject{Key: objectKey{"pg_namespace", 1}, Type: "SCHEMA", Name: "app"}
+	table := packObject{Key: objectKey{"pg_class", 2}, Type: "TABLE", Schema: "app", Name: "t", Deps: []objectKey{schema.Key, {"pg_type", 3}}}
+	data := packObject{Type: "TABLE DATA", Schema: "app", Name: "t", Deps: []objectKey{table.Key}}
+
+	contents = []string{
+		"CREATE SCHEMA IF NOT EXISTS app;\n",
+		"CREATE TABLE app.t (id integer, name text);\n",
+		records.String(),
+	}
+
+	io.WriteString(w, "-- Comments between entries are left out\n")
+	for i, object := range []packObject{schema, table, data} {
+		if err := w.writeEntry(object, contents[i]); err != nil {
+			t.Fatalf("writeEntry: %v", err)
+		}
+	}
+	if err := w.writeEntry(packObject{Type: "SETTINGS"}, "  \n"); err != nil {
+		t.Fatalf("writeEntry: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return filename, contents
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, codec := range compressionCodecs {
+		t.Run(codec.name, func(t *testing.T) {
+			filename, contents := writeTestArchive(t, codec.name)
+
+			f, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			archive, err := openArchive(f)
+			if err != nil {
+				t.Fatalf("openArchive: %v", err)
+			}
+
+			if archive.codec.id != codec.id {
+				t.Errorf("archive codec is %s, want %s", archive.codec.name, codec.name)
+			}
+
+			if len(archive.entries) != 3 {
+				t.Fatalf("archive has %d entries, want 3", len(archive.entries))
+			}
+			if deps := archive.entries[1].Deps; len(deps) != 1 || deps[0] != archive.entries[0].ID {
+				t.Errorf("table entry depends on %v, want [%d]", deps, archive.entries[0].ID)
+			}
+			if deps := archive.entries[2].Deps; len(deps) != 1 || deps[0] != archive.entries[1].ID {
+				t.Errorf("data entry depends on %v, want [%d]", deps, archive.entries[1].ID)
+			}
+
+			script, err := io.ReadAll(archive.script(archive.entries))
+			if err != nil {
+				t.Fatalf("reading script: %v", err)
+			}
+			if string(script) != strings.Join(contents, "") {
+				t.Errorf("script does not match the written entries")
+			}
+
+			single, err := io.ReadAll(archive.script(archive.entries[1:2]))
+			if err != nil {
+				t.Fatalf("reading entry: %v", err)
+			}
+			if string(single) != contents[1] {
+				t.Errorf("entry 2 reads %q, want %q", single, contents[1])
+			}
+		})
+	}
+}
+
+func TestArchiveCorruption(t *testing.T) {
+	for _, codec := range compressionCodecs {
+		t.Run(codec.name, func(t *testing.T) {
+			filename, _ := writeTestArchive(t, codec.name)
+
+			f, err := os.OpenFile(filename, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			archive, err := openArchive(f)
+			if err != nil {
+				t.Fatalf("openArchive: %v", err)
+			}
+
+			// Flip a byte in the middle of the segment of the data records
+			entry := archive.entries[2]
+			offset := entry.Offset + entry.Length/2
+			b := make([]byte, 1)
+			if _, err := f.ReadAt(b, offset); err != nil {
+				t.Fatal(err)
+			}
+			b[0] ^= 0xff
+			if _, err := f.WriteAt(b, offset); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = io.ReadAll(archive.script(archive.entries))
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("reading a corrupted entry returned %v, want a checksum mismatch", err)
+			}
+
+			// The entries before the corrupted one are still readable
+			if _, err := io.ReadAll(archive.script(archive.entries[:2])); err != nil {
+				t.Errorf("reading intact entries: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	filename, _ := writeTestArchive(t, "zstd")
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, info.Size()-4); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := openArchive(f); err == nil {
+		t.Errorf("openArchive accepted a truncated package")
+	}
+}
+
+func TestArchiveRejectsStatementsOutsideEntries(t *testing.T) {
+	m := Manager{Options: &Options{Compress: true, CompressAlgorithm: "zstd"}}
+	w, err := m.newPackageWriter(io.Discard)
+	if err != nil {
+		t.Fatalf("newPackageWriter: %v", err)
+	}
+
+	if _, err := io.WriteString(w, "\n-- START OF RECORDS\n  -- indented\n\n"); err != nil {
+		t.Errorf("writing comments outside of an entry: %v", err)
+	}
+	if _, err := io.WriteString(w, "-- Table: app.t\nSELECT 1;\n"); err == nil {
+		t.Errorf("writing a statement outside of an entry succeeded")
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// packMagic opens every compressed package. It is followed by the version
+// of the package format and the ID of the codec the package is compressed
+// with, so Restore can tell how to decompress it.
+const packMagic = "PGPACK"
+
+// packFormatVersion is the version of the package format written by Pack.
+// Packages of version 1 are a single compressed stream of the plain package,
+// version 2 introduced archives (see archive.go).
+const packFormatVersion = 2
+
+// compressionCodec is a compression algorithm packages can be compressed with.
+// Levels range from minLevel to maxLevel, a level of 0 selects defaultLevel.
+type compressionCodec struct {
+	id           byte
+	name         string
+	minLevel     int
+	maxLevel     int
+	defaultLevel int
+	newWriter    func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader    func(r io.Reader) (io.ReadCloser, error)
+}
+
+// compressionCodecs lists the supported codecs. Their IDs are written to
+// the packages and must never change.
+var compressionCodecs = []compressionCodec{
+	{
+		id: 1, name: "brotli", minLevel: 1, maxLevel: 11, defaultLevel: 11,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return brotli.NewWriterLevel(w, level), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		},
+	},
+	{
+		id: 2, name: "zstd", minLevel: 1, maxLevel: 22, defaultLevel: 3,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		id: 3, name: "gzip", minLevel: 1, maxLevel: 9, defaultLevel: gzip.DefaultCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		// The default level of lz4 is its fast mode
+		id: 4, name: "lz4", minLevel: 1, maxLevel: 9, defaultLevel: 0,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			compressionLevel := lz4.Fast
+			if level > 0 {
+				compressionLevel = lz4.Level1 << (level - 1)
+			}
+
+			writer := lz4.NewWriter(w)
+			if err := writer.Apply(lz4.CompressionLevelOption(compressionLevel)); err != nil {
+				return nil, err
+			}
+			return writer, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+}
+
+// getCompressionCodec returns the codec with the given name.
+func getCompressionCodec(name string) (compressionCodec, error) {
+	names := make([]string, 0, len(compressionCodecs)+1)
+	for _, codec := range compressionCodecs {
+		if codec.name == name {
+			return codec, nil
+		}
+		names = append(names, codec.name)
+	}
+	names = append(names, "none")
+
+	return compressionCodec{}, fmt.Errorf("unknown compression algorithm '%s'. Use one of: %s.", name, strings.Join(names, ", "))
+}
+
+// getCompressionCodecByID returns the codec with the given ID.
+func getCompressionCodecByID(id byte) (compressionCodec, error) {
+	for _, codec := range compressionCodecs {
+		if codec.id == id {
+			return codec, nil
+		}
+	}
+
+	return compressionCodec{}, fmt.Errorf("unknown compression codec %d", id)
+}
+
+// getPackageFilename returns the name of the file Pack writes the package to.
+// Compressed packages replace the extension of the output filename with '.pack'.
+func (m Manager) getPackageFilename() string {
+	if !m.Options.Compress {
+		return *m.OutputFilename
+	}
+
+	fileNameSegments := strings.Split(*m.OutputFilename, ".")
+
+	if len(fileNameSegments) == 1 {
+		fileNameSegments = append(fileNameSegments, "")
+	}
+
+	return fmt.Sprintf("%s.pack", strings.Join(fileNameSegments[0:len(fileNameSegments)-1], "."))
+}
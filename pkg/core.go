@@ -2,17 +2,17 @@ package core
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
-	"log"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
-	"time"
 
-	"github.com/andybalholm/brotli"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
 const (
@@ -20,6 +20,10 @@ const (
 	PostgresBigintMax = 9223372036854775807
 )
 
+// packageHeader is the first line of every package written by Pack.
+// Restore relies on it to tell plain packages apart from compressed ones.
+const packageHeader = "-- This file was created by pg_pack. DO NOT MODIFY."
+
 type ConnectionCreds struct {
 	Host     string
 	Port     int16
@@ -31,18 +35,64 @@ type ConnectionCreds struct {
 
 // Options contains configuration options for the packager.
 // DataOnly controls whether to include schema in dump.
-// Compress enables brotli compression on dump file.
+// SchemaOnly controls whether to exclude data records from dump.
+// Compress enables compression on dump file.
+// CompressAlgorithm selects the compression codec (brotli, zstd, gzip, lz4 or none).
+// CompressLevel sets the compression level, 0 selects the codec's default level.
 // RecordMode sets the output format for table rows.
+// Jobs sets how many tables have their records dumped in parallel.
+// RefreshMaterializedViews populates materialized views after the records are loaded.
+// RenameSchemas maps schema names in the database to the names they get once restored.
+// Schemas, ExcludeSchemas, Tables and ExcludeTables select the objects to pack,
+// or to restore from a package. They hold patterns (see namePattern).
+// ExcludeTableData selects tables whose definitions are packed without their data records.
+// RowFilters restrict the data records packed for some tables, given as 'table: predicate'.
+// RowFiltersFile names a file holding more row filters, one per line.
+// SubsetTable enables subset mode (see getSubset): only the records of this table
+// selected by SubsetFilter and SubsetSize are packed, along with the records they reference.
+// MaskingRulesFile names a file of masking rules (see getMaskingRules) scrubbing column values.
+// MaskingKey is the secret the deterministic masking transformers derive their output from.
 type Options struct {
-	DataOnly   bool
-	Compress   bool
-	RecordMode string
+	DataOnly                 bool
+	SchemaOnly               bool
+	Compress                 bool
+	CompressAlgorithm        string
+	CompressLevel            int
+	RecordMode               string
+	Jobs                     int
+	RefreshMaterializedViews bool
+	RenameSchemas            map[string]string
+	Schemas                  []string
+	ExcludeSchemas           []string
+	Tables                   []string
+	ExcludeTables            []string
+	ExcludeTableData         []string
+	RowFilters               []string
+	RowFiltersFile           string
+	SubsetTable              string
+	SubsetFilter             string
+	SubsetSize               int
+	MaskingRulesFile         string
+	MaskingKey               string
 }
 
 type Manager struct {
 	OutputFilename *string
 	Database       *sql.DB
 	Options        *Options
+
+	// snapshot is the read-only transaction every query of a pack job runs in,
+	// so that the whole package reflects a single instant of the database.
+	// conn is the dedicated connection the transaction was started on.
+	snapshot *sql.Tx
+	conn     *sql.Conn
+
+	// rowFilters holds the parsed row filters of a pack job.
+	// subset holds the predicates of the tables packed in subset mode.
+	// maskingRules holds the parsed masking rules of a pack job.
+	rowFilters   []rowFilter
+	subset       map[relationName]string
+	maskingRules []maskingRule
 }
 
 // NewManager creates a new Manager instance with the given output file,
@@ -54,15 +104,15 @@ type Manager struct {
 func NewManager(outputFile *string, connData *ConnectionCreds, options *Options) (Manager, error) {
 	sslMode := "disable"
 	if connData.SSL {
-		sslMode = "enable"
+		sslMode = "require"
 	}
 
-	db, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s&TimeZone=UTC", url.QueryEscape(connData.Username), url.QueryEscape(connData.Password), connData.Host, connData.Port, connData.Database, sslMode))
+	db, err := sql.Open("pgx", fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s&TimeZone=UTC", url.QueryEscape(connData.Username), url.QueryEscape(connData.Password), connData.Host, connData.Port, connData.Database, sslMode))
 	if err != nil {
 		return Manager{}, fmt.Errorf("error while connecting to the database: %v", err)
 	}
 
-	return Manager{outputFile, db, options}, nil
+	return Manager{OutputFilename: outputFile, Database: db, Options: options}, nil
 }
 
 // getLockFilename returns the filename to use for the lock file.
@@ -81,7 +131,50 @@ func (m Manager) init() error {
 	}
 	m.Options.RecordMode = recordMode
 
-	if _, err := os.Stat(*m.OutputFilename); err == nil {
+	if m.Options.DataOnly && m.Options.SchemaOnly {
+		return fmt.Errorf("data-only and schema-only modes cannot be used together.")
+	}
+
+	m.Options.CompressAlgorithm = strings.ToLower(m.Options.CompressAlgorithm)
+	if m.Options.CompressAlgorithm == "" {
+		m.Options.CompressAlgorithm = "brotli"
+	}
+	if m.Options.CompressAlgorithm == "none" {
+		m.Options.Compress = false
+	} else {
+		codec, err := getCompressionCodec(m.Options.CompressAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		if level := m.Options.CompressLevel; level != 0 && (level < codec.minLevel || level > codec.maxLevel) {
+			return fmt.Errorf("invalid compression level for %s. It must be between %d and %d.", codec.name, codec.minLevel, codec.maxLevel)
+		}
+	}
+
+	if _, err := m.Options.compileFilter(); err != nil {
+		return err
+	}
+
+	if !m.Options.isSubset() && (m.Options.SubsetFilter != "" || m.Options.SubsetSize != 0) {
+		return fmt.Errorf("subset filter and size require a subset table.")
+	}
+
+	if m.Options.SubsetSize < 0 {
+		return fmt.Errorf("invalid subset size. It must be positive.")
+	}
+
+	if m.Options.Jobs < 1 {
+		return fmt.Errorf("invalid number of jobs. It must be at least 1.")
+	}
+
+	for oldName, newName := range m.Options.RenameSchemas {
+		if newName == "" || len(newName) > maxIdentifierLength {
+			return fmt.Errorf("invalid new name for schema '%s'. It must be between 1 and %d bytes long.", oldName, maxIdentifierLength)
+		}
+	}
+
+	if _, err := os.Stat(m.getPackageFilename()); err == nil {
 		fmt.Print("the specified output file already exists. Overwrite [y/N]? ")
 
 		reader := bufio.NewReader(os.Stdin)
@@ -95,7 +188,7 @@ func (m Manager) init() error {
 	}
 
 	var d []byte
-	if err := os.WriteFile(*m.OutputFilename, d, 0644); err != nil {
+	if err := os.WriteFile(m.getPackageFilename(), d, 0644); err != nil {
 		return fmt.Errorf("cannot write to output file: %v", err)
 	}
 
@@ -119,6 +212,62 @@ func (m Manager) cleanup() error {
 	return nil
 }
 
+// beginSnapshot returns a copy of the Manager whose queries run in a new
+// read-only, repeatable-read transaction on a dedicated connection. If
+// snapshotID is not empty, the transaction is attached to that exported
+// snapshot. The transaction must be released with endSnapshot.
+func (m Manager) beginSnapshot(ctx context.Context, snapshotID string) (Manager, error) {
+	conn, err := m.Database.Conn(ctx)
+	if err != nil {
+		return Manager{}, fmt.Errorf("error while connecting to the database: %v", err)
+	}
+
+	snapshot, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		conn.Close()
+		return Manager{}, fmt.Errorf("cannot start snapshot transaction: %v", err)
+	}
+
+	m.conn, m.snapshot = conn, snapshot
+
+	if snapshotID != "" {
+		if _, err := snapshot.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshotID)); err != nil {
+			m.endSnapshot()
+			return Manager{}, fmt.Errorf("cannot attach to snapshot %s: %v", snapshotID, err)
+		}
+	}
+
+	// With an empty search_path, the definitions generated by the server
+	// (views, indexes, constraints, ...) reference every object by its
+	// schema-qualified name, which is what the package needs.
+	if _, err := snapshot.Exec("SET LOCAL search_path = ''"); err != nil {
+		m.endSnapshot()
+		return Manager{}, fmt.Errorf("cannot reset search_path: %v", err)
+	}
+
+	// Data records are read in the text format of the server. Pin down the
+	// settings it depends on, so that every value reads back as it was.
+	for _, setting := range []string{
+		"SET LOCAL DateStyle = ISO",
+		"SET LOCAL IntervalStyle = postgres",
+		"SET LOCAL extra_float_digits = 3",
+		"SET LOCAL bytea_output = hex",
+	} {
+		if _, err := snapshot.Exec(setting); err != nil {
+			m.endSnapshot()
+			return Manager{}, fmt.Errorf("cannot configure snapshot: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+// endSnapshot rolls back the snapshot transaction and releases its connection.
+func (m Manager) endSnapshot() {
+	m.snapshot.Rollback()
+	m.conn.Close()
+}
+
 func (m Manager) Pack() error {
 	if err := m.init(); err != nil {
 		return fmt.Errorf("cannot initialize pack job: %v", err)
@@ -126,208 +275,263 @@ func (m Manager) Pack() error {
 
 	defer m.cleanup()
 
-	// Open the output file
-	outputFile, err := os.Create(*m.OutputFilename)
+	rowFilters, err := m.Options.getRowFilters()
+	if err != nil {
+		return fmt.Errorf("cannot initialize pack job: %v", err)
+	}
+	m.rowFilters = rowFilters
+
+	maskingRules, err := m.Options.getMaskingRules()
+	if err != nil {
+		return fmt.Errorf("cannot initialize pack job: %v", err)
+	}
+	m.maskingRules = maskingRules
+
+	// Read everything inside one consistent snapshot
+	m, err = m.beginSnapshot(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	defer m.endSnapshot()
+
+	// Parallel workers attach to the very same snapshot on their own connections
+	var snapshotID string
+	if m.Options.Jobs > 1 {
+		if err := m.snapshot.QueryRow("SELECT pg_export_snapshot()").Scan(&snapshotID); err != nil {
+			return fmt.Errorf("cannot export snapshot: %v", err)
+		}
+	}
+
+	// Open the output file. Compressed packages are compressed on the fly,
+	// so the plain package never hits the disk.
+	outputFile, err := os.Create(m.getPackageFilename())
 	if err != nil {
 		return fmt.Errorf("error while creating output file: %v", err)
 	}
+	defer outputFile.Close()
+
+	// A failed pack job must not leave a package behind, as it would
+	// look like a valid one missing some records.
+	completed := false
+	defer func() {
+		if !completed {
+			os.Remove(m.getPackageFilename())
+		}
+	}()
 
-	outputFile.WriteString("-- This file was created by pg_pack. DO NOT MODIFY.\n\n")
+	w, err := m.newPackageWriter(outputFile)
+	if err != nil {
+		return fmt.Errorf("error while writing output file: %v", err)
+	}
 
-	outputFile.WriteString("SET client_encoding = 'UTF8';\n")
-	outputFile.WriteString("SET statement_timeout = 0;\n")
-	outputFile.WriteString("SET lock_timeout = 0;\n")
-	outputFile.WriteString("SET idle_in_transaction_session_timeout = 0;\n")
-	outputFile.WriteString("SET standard_conforming_strings = on;\n")
-	outputFile.WriteString("SET check_function_bodies = false;\n")
-	outputFile.WriteString("SET xmloption = content;\n")
-	outputFile.WriteString("SET client_min_messages = warning;\n")
-	outputFile.WriteString("SET row_security = off;\n")
-	outputFile.WriteString("SELECT pg_catalog.set_config('search_path', '', false);\n")
+	io.WriteString(w, packageHeader+"\n\n")
+
+	settings := "SET client_encoding = 'UTF8';\n" +
+		"SET statement_timeout = 0;\n" +
+		"SET lock_timeout = 0;\n" +
+		"SET idle_in_transaction_session_timeout = 0;\n" +
+		"SET standard_conforming_strings = on;\n" +
+		"SET check_function_bodies = false;\n" +
+		"SET xmloption = content;\n" +
+		"SET client_min_messages = warning;\n" +
+		"SET row_security = off;\n" +
+		"SELECT pg_catalog.set_config('search_path', '', false);\n"
+	if err := w.writeEntry(packObject{Type: "SETTINGS"}, settings); err != nil {
+		return fmt.Errorf("error while writing output file: %v", err)
+	}
+
+	filter, err := m.Options.compileFilter()
+	if err != nil {
+		return err
+	}
 
 	// Create tables
-	schemas, err := m.getSchemas()
+	schemas, err := m.getSchemas(filter)
 	if err != nil {
 		return fmt.Errorf("error while fetching schemas: %v", err)
 	}
 
-	for _, schema := range schemas {
-		// Get the list of tables in the database
-		tables, err := m.getTables(schema)
-		if err != nil {
-			return fmt.Errorf("error while fetching tables: %v", err)
+	// Objects of all schemas are ordered together, as they may reference each other
+	objects, err := m.getDefinitions(schemas, filter)
+	if err != nil {
+		return err
+	}
+	schemas = filter.packedSchemas(schemas, objects)
+	w.packed = packedObjectNames(objects)
+
+	if !m.Options.DataOnly {
+		if err := m.writeSchemas(w, schemas); err != nil {
+			return err
 		}
+	}
 
-		// Drop tables
-		_, err = outputFile.WriteString("\n-- START OF DROPPING TABLES\n")
-		for _, table := range tables {
-			dropTableStmt := fmt.Sprintf("DROP TABLE IF EXISTS %s;", table)
+	tables := filterObjects(objects, "TABLE")
+	sequences := filterObjects(objects, "SEQUENCE")
 
-			_, err = outputFile.WriteString(dropTableStmt + "\n")
-			if err != nil {
-				return fmt.Errorf("error while writing DROP statement: %v", err)
-			}
+	if !m.Options.DataOnly {
+		if err := writeDrops(w, objects); err != nil {
+			return err
 		}
-		_, err = outputFile.WriteString("-- END OF DROPPING TABLES\n")
 
-		// Types
-		_, err = outputFile.WriteString("\n-- START OF CREATING TYPES\n")
-		typeStmt, err := m.getCreateTypeStatements(schema) // Only supports Enums for now
-		if err != nil {
-			return fmt.Errorf("error while constructing CREATE TYPE statement: %v", err)
+		if err := writeDefinitions(w, objects); err != nil {
+			return err
 		}
-		_, err = outputFile.WriteString(typeStmt + "\n")
-		_, err = outputFile.WriteString("-- END OF CREATING TYPES\n")
 
-		// Domains
-		_, err = outputFile.WriteString("\n-- START OF DOMAINS\n")
-		domainStmt, err := m.getDomainStatements(schema)
-		if err != nil {
-			return fmt.Errorf("error while constructing DOMAIN statement: %v", err)
+		if err := m.writeSequenceOwnerships(w, sequences, tables); err != nil {
+			return err
 		}
+	}
 
-		_, err = outputFile.WriteString(domainStmt + "\n")
-		if err != nil {
-			return fmt.Errorf("error while writing DOMAIN statement: %v", err)
+	if !m.Options.SchemaOnly {
+		if m.Options.isSubset() {
+			if m.subset, err = m.getSubset(tables); err != nil {
+				return err
+			}
 		}
-		_, err = outputFile.WriteString("-- END OF DOMAINS\n")
 
-		// Functions
-		_, err = outputFile.WriteString("\n-- START OF FUNCTIONS\n")
-		functionStmt, err := m.getFunctionStatements(schema)
-		if err != nil {
-			return fmt.Errorf("error while constructing FUNCTION statement: %v", err)
+		var dataTables []packObject
+		for _, table := range tables {
+			if filter.excludesTableData(table) {
+				continue
+			}
+			if _, ok := m.subset[relationName{table.Schema, table.Name}]; m.Options.isSubset() && !ok {
+				continue
+			}
+			dataTables = append(dataTables, table)
 		}
 
-		_, err = outputFile.WriteString(functionStmt + "\n")
-		if err != nil {
-			return fmt.Errorf("error while writing FUNCTION statement: %v", err)
+		if err := m.writeRecords(w, dataTables, snapshotID); err != nil {
+			return err
 		}
-		_, err = outputFile.WriteString("-- END OF FUNCTIONS\n")
 
-		// Sequences
-		_, err = outputFile.WriteString("\n-- START OF SEQUENCES\n")
-		sequenceStmt, err := m.getSequenceStatements(schema)
-		if err != nil {
-			return fmt.Errorf("error while constructing SEQUENCE statement: %v", err)
+		if err := m.writeSequenceValues(w, sequences); err != nil {
+			return err
 		}
+	}
 
-		_, err = outputFile.WriteString(sequenceStmt + "\n")
-		if err != nil {
-			return fmt.Errorf("error while writing SEQUENCE statement: %v", err)
+	// Foreign keys are added once every table holds its records
+	if !m.Options.DataOnly {
+		if err := m.writeConstraints(w, tables); err != nil {
+			return err
 		}
-		_, err = outputFile.WriteString("-- END OF SEQUENCES\n")
 
-		_, err = outputFile.WriteString("\n-- START OF CREATING TABLES\n")
-		for _, table := range tables {
-			createTableStmt, err := m.getCreateTableStatement(table, schema)
-			if err != nil {
-				return fmt.Errorf("error while constructing CREATE statement: %v", err)
-			}
-			_, err = outputFile.WriteString(createTableStmt + "\n\n")
-			if err != nil {
-				return fmt.Errorf("error while writing CREATE statement: %v", err)
-			}
+		// Triggers come last, so that they do not fire while the records are loaded
+		if err := m.writeTriggers(w, filterObjects(objects, "TABLE", "VIEW")); err != nil {
+			return err
 		}
-		_, err = outputFile.WriteString("-- END OF CREATING TABLES\n")
+	}
 
-		_, err = outputFile.WriteString("\n-- START OF RECORDS\n")
-		// Add records
-		for _, table := range tables {
-			_, err = outputFile.WriteString("\n-- Table: " + table + "\n")
-
-			ch := make(chan string)
-			switch m.Options.RecordMode {
-			case "insert":
-				err = m.broadcastTableRecordsINSERT(table, schema, ch)
-			case "copy":
-				err = m.broadcastTableRecordsCOPY(table, schema, ch)
-			}
+	if !m.Options.SchemaOnly && m.Options.RefreshMaterializedViews {
+		if err := writeViewRefreshes(w, objects); err != nil {
+			return err
+		}
+	}
 
-			if err != nil {
-				return fmt.Errorf("error while receiving data records: %v", err)
-			}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error while writing output file: %v", err)
+	}
 
-			for record := range ch {
-				_, err = outputFile.WriteString(record)
-				if err != nil {
-					return fmt.Errorf("error while writing data records: %v", err)
-				}
-			}
-		}
-		outputFile.WriteString("-- END OF RECORDS\n")
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("error while writing output file: %v", err)
+	}
 
-		// Constraints
-		_, err = outputFile.WriteString("\n-- START OF CONSTRAINTS\n")
-		for _, table := range tables {
-			outputFile.WriteString("\n-- Constraint: PRIMARY KEY\tTable: " + table + "\n")
+	completed = true
+	return nil
+}
 
-			pkStmt, err := m.getPrimaryKeyStatements(table, schema)
-			if err != nil {
-				return err
-			}
+// writeRecords writes the data records of the given tables to w.
+// The records of every table make up an entry of their own.
+func (m Manager) writeRecords(w *packageWriter, tables []packObject, snapshotID string) error {
+	_, err := io.WriteString(w, "\n-- START OF RECORDS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing data records: %v", err)
+	}
 
-			_, err = outputFile.WriteString(pkStmt + "\n")
-			if err != nil {
-				return err
-			}
+	if m.Options.Jobs > 1 {
+		if err := m.writeRecordsParallel(w, tables, snapshotID); err != nil {
+			return err
 		}
+	} else {
 		for _, table := range tables {
-			outputFile.WriteString("\n-- Constraint: FOREIGN KEY\tTable: " + table + "\n")
-			fkStmt, err := m.getForeignKeyStatements(table, schema)
-			if err != nil {
-				return err
+			if err := w.beginEntry(tableDataObject(table)); err != nil {
+				return fmt.Errorf("error while writing data records: %v", err)
 			}
 
-			_, err = outputFile.WriteString(fkStmt + "\n")
-			if err != nil {
-				return err
+			if err := m.writeTableRecords(context.Background(), w, table.Name, table.Schema); err != nil {
+				return fmt.Errorf("error while dumping table %s.%s: %v", table.Schema, table.Name, err)
+			}
+
+			if err := w.endEntry(); err != nil {
+				return fmt.Errorf("error while writing data records: %v", err)
 			}
 		}
-		_, err = outputFile.WriteString("-- END OF CONSTRAINTS\n")
 	}
 
-	outputFile.Close()
-
-	// Compress
-	if m.Options.Compress {
-		fileNameSegments := strings.Split(*m.OutputFilename, ".")
+	_, err = io.WriteString(w, "-- END OF RECORDS\n")
+	return err
+}
 
-		if len (fileNameSegments) == 1 {
-			fileNameSegments = append(fileNameSegments, "")
-		}
-		
-		compOutFilename := fmt.Sprintf("%s.pack", strings.Join(fileNameSegments[0:len(fileNameSegments)-1], "."))
-		compOutFile, _ := os.Create(compOutFilename)
-		defer compOutFile.Close()
+// tableDataObject returns the object the data records of a table stand for.
+func tableDataObject(table packObject) packObject {
+	return packObject{Type: "TABLE DATA", Schema: table.Schema, Name: table.Name, Deps: []objectKey{table.Key}}
+}
 
-		outputFile, err := os.Open(*m.OutputFilename)
-		if err != nil {
-			log.Fatal(err)
+// writeConstraints writes the constraints of the given tables to w.
+// They are added after the data records are loaded.
+func (m Manager) writeConstraints(w *packageWriter, tables []packObject) error {
+	constraints := func(types ...string) func(tableName string, schema string) (string, error) {
+		return func(tableName string, schema string) (string, error) {
+			return m.getConstraintStatements(tableName, schema, types)
 		}
+	}
 
-		// Create brotli writer
-		writer := brotli.NewWriterLevel(compOutFile, brotli.BestCompression)
-		defer writer.Close()
+	sections := []struct {
+		entryType string
+		comment   string
+		generate  func(tableName string, schema string) (string, error)
+	}{
+		{"PRIMARY KEY", "Constraint: PRIMARY KEY", constraints("p")},
+		{"CONSTRAINT", "Constraint: UNIQUE, CHECK, EXCLUDE", constraints("u", "c", "x")},
+		{"INDEX", "Index", m.getIndexStatements},
+		{"FK CONSTRAINT", "Constraint: FOREIGN KEY", constraints("f")},
+	}
 
-		// Copy & compress input file to output file
-		_, err = io.Copy(writer, outputFile)
-		if err != nil {
-			return fmt.Errorf("error while compressing pack file: %v", err)
-		}
+	_, err := io.WriteString(w, "\n-- START OF CONSTRAINTS\n")
+	for _, section := range sections {
+		for _, table := range tables {
+			io.WriteString(w, "\n-- "+section.comment+"\tTable: "+commentText(qualifiedName(table.Schema, table.Name))+"\n")
 
-		outputFile.Close()
+			stmt, err := section.generate(table.Name, table.Schema)
+			if err != nil {
+				return err
+			}
 
-		if err = os.Remove(outputFile.Name()); err != nil {
-			return fmt.Errorf("error while deleting plain pack file: %v", err)
+			object := packObject{Type: section.entryType, Schema: table.Schema, Name: table.Name, Deps: []objectKey{table.Key}}
+			if err := w.writeEntry(object, stmt+"\n"); err != nil {
+				return err
+			}
 		}
 	}
+	_, err = io.WriteString(w, "-- END OF CONSTRAINTS\n")
 
-	return nil
+	return err
 }
 
-func (m Manager) getSchemas() ([]string, error) {
-	rows, err := m.Database.Query("SELECT schema_name FROM information_schema.schemata")
+// getSchemas returns the user schemas the filter includes.
+func (m Manager) getSchemas(filter objectFilter) ([]string, error) {
+	// Schemas created by extensions are left to the extensions
+	rows, err := m.snapshot.Query(`
+		SELECT s.schema_name
+		FROM information_schema.schemata s
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM pg_catalog.pg_depend d
+			JOIN pg_catalog.pg_namespace n ON n.oid = d.objid
+			WHERE d.classid = 'pg_catalog.pg_namespace'::regclass
+				AND d.deptype = 'e'
+				AND n.nspname = s.schema_name
+		);
+	`)
 	if err != nil {
 		return nil, err
 	}
@@ -341,7 +545,11 @@ func (m Manager) getSchemas() ([]string, error) {
 			return nil, err
 		}
 
-		if schemaName == "information_schema" || schemaName == "pg_catalog" || schemaName == "pg_toast" {
+		if schemaName == "information_schema" || schemaName == "pg_catalog" || schemaName == "pg_toast" ||
+			strings.HasPrefix(schemaName, "pg_temp_") || strings.HasPrefix(schemaName, "pg_toast_temp_") {
+			continue
+		}
+		if !filter.includesSchema(schemaName) {
 			continue
 		}
 		schemas = append(schemas, schemaName)
@@ -350,36 +558,130 @@ func (m Manager) getSchemas() ([]string, error) {
 	return schemas, nil
 }
 
-func (m Manager) getTables(schema string) ([]string, error) {
-	rows, err := m.Database.Query(`SELECT
-		table_name
-		FROM information_schema.tables
-		WHERE table_schema=$1
-		AND table_type='BASE TABLE'
+// writeSchemas writes the statements creating the given schemas to w.
+// They come before any other object, since objects may reference
+// schemas other than their own.
+func (m Manager) writeSchemas(w *packageWriter, schemas []string) error {
+	_, err := io.WriteString(w, "\n-- START OF SCHEMAS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing SCHEMA statement: %v", err)
+	}
+
+	for _, schema := range schemas {
+		object, err := m.getSchemaObject(schema)
+		if err != nil {
+			return fmt.Errorf("error while constructing SCHEMA statement: %v", err)
+		}
+
+		if err := w.writeEntry(object, object.Statement+"\n"); err != nil {
+			return fmt.Errorf("error while writing SCHEMA statement: %v", err)
+		}
+	}
+
+	_, err = io.WriteString(w, "-- END OF SCHEMAS\n")
+	return err
+}
+
+// getSchemaObject returns the statements creating a schema.
+func (m Manager) getSchemaObject(schema string) (packObject, error) {
+	var (
+		oid     uint32
+		owner   string
+		comment sql.NullString
+	)
+
+	err := m.snapshot.QueryRow(`
+		SELECT
+			n.oid,
+			pg_catalog.pg_get_userbyid(n.nspowner) AS owner,
+			pg_catalog.obj_description(n.oid, 'pg_namespace') AS comment
+		FROM pg_catalog.pg_namespace n
+		WHERE n.nspname = $1;
+	`, schema).Scan(&oid, &owner, &comment)
+	if err != nil {
+		return packObject{}, err
+	}
+
+	name := quoteIdent(renamedSchema(schema, m.Options.RenameSchemas))
+	stmt := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;\n", name)
+	stmt += fmt.Sprintf("ALTER SCHEMA %s OWNER TO %s;\n", name, quoteIdent(owner))
+	if comment.Valid {
+		stmt += fmt.Sprintf("COMMENT ON SCHEMA %s IS %s;\n", name, quoteLiteral(comment.String))
+	}
+
+	return packObject{
+		Key:       objectKey{"pg_namespace", oid},
+		Type:      "SCHEMA",
+		Name:      schema,
+		Statement: stmt,
+	}, nil
+}
+
+// getTables returns the tables of the schema. Partitioned tables and their
+// partitions cannot be packed yet: rather than recreating them as plain
+// tables, it fails unless the filter excludes them.
+func (m Manager) getTables(schema string, filter objectFilter) ([]packObject, error) {
+	// relispartition is missing from servers older than PostgreSQL 10, so it
+	// is read through to_jsonb
+	rows, err := m.snapshot.Query(`SELECT
+		c.oid,
+		c.relname,
+		c.relkind = 'p' OR COALESCE((pg_catalog.to_jsonb(c) ->> 'relispartition')::boolean, false)
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1
+		AND c.relkind IN ('r', 'p')
+		ORDER BY c.relname
 	`, schema)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var tables []string
+	var tables []packObject
 	for rows.Next() {
-		var tableName string
-		err := rows.Scan(&tableName)
+		var (
+			oid         uint32
+			tableName   string
+			partitioned bool
+		)
+		err := rows.Scan(&oid, &tableName, &partitioned)
 		if err != nil {
 			return nil, err
 		}
-		tables = append(tables, tableName)
+
+		if partitioned {
+			if matchesAny(filter.excludeTables, schema, tableName) {
+				continue
+			}
+			return nil, fmt.Errorf("table %s is partitioned or a partition, which is not supported yet. Leave it out with --exclude-table.", qualifiedName(schema, tableName))
+		}
+
+		tables = append(tables, packObject{
+			Key:    objectKey{"pg_class", oid},
+			Type:   "TABLE",
+			Schema: schema,
+			Name:   tableName,
+		})
 	}
 
-	return tables, nil
+	return tables, rows.Err()
+}
+
+// tableColumn describes a column of a table, mostly as information_schema does.
+type tableColumn struct {
+	name, dataType, isNullable, columnDefault, udtName, typeSchema sql.NullString
+	characterMaximumLength, numericPrecision, numericScale         sql.NullInt64
+	generationExpression                                           sql.NullString // Expression of stored generated columns
 }
 
 func (m Manager) getCreateTableStatement(tableName string, schema string) (string, error) {
 	// Query retrieves column metadata for the given table from the PostgreSQL
 	// information_schema and pg_catalog system tables. Joining the tables is to
 	// fetch some additional info like the namespace for user-defined types.
-	rows, err := m.Database.Query(`SELECT
+	// attgenerated is missing from servers older than PostgreSQL 12, so it is
+	// read through to_jsonb.
+	rows, err := m.snapshot.Query(`SELECT
 			c.column_name,
 			c.data_type,
 			c.is_nullable,
@@ -388,10 +690,17 @@ func (m Manager) getCreateTableStatement(tableName string, schema string) (strin
 			c.numeric_precision,
 			c.numeric_scale,
 			c.udt_name, --type name (user-defined/array types)
-			n.nspname as type_schema --type schema
+			n.nspname as type_schema, --type schema
+			CASE WHEN pg_catalog.to_jsonb(a) ->> 'attgenerated' = 's'
+				THEN pg_catalog.pg_get_expr(d.adbin, d.adrelid)
+			END AS generation_expression
 		FROM information_schema.columns c
 		LEFT JOIN pg_catalog.pg_type t ON c.udt_name = t.typname --user-defined types
 		LEFT JOIN pg_catalog.pg_namespace n ON t.typnamespace = n.oid
+		JOIN pg_catalog.pg_namespace tn ON tn.nspname = c.table_schema
+		JOIN pg_catalog.pg_class tc ON tc.relnamespace = tn.oid AND tc.relname = c.table_name
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = tc.oid AND a.attname = c.column_name
+		LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
 		WHERE c.table_name = $1 AND c.table_schema = $2
 		ORDER BY c.ordinal_position;`,
 		tableName, schema)
@@ -402,304 +711,471 @@ func (m Manager) getCreateTableStatement(tableName string, schema string) (strin
 
 	columnDefs := make([]string, 0)
 	for rows.Next() {
-		var columnName, dataType, isNullable, columnDefault, udtName, typeSchema sql.NullString
-		var characterMaximumLength, numericPrecision, numericScale sql.NullInt64
-		err := rows.Scan(&columnName, &dataType, &isNullable, &columnDefault, &characterMaximumLength, &numericPrecision, &numericScale, &udtName, &typeSchema)
+		var column tableColumn
+		err := rows.Scan(&column.name, &column.dataType, &column.isNullable, &column.columnDefault, &column.characterMaximumLength,
+			&column.numericPrecision, &column.numericScale, &column.udtName, &column.typeSchema, &column.generationExpression)
 		if err != nil {
 			return "", err
 		}
 
-		if !(columnName.Valid && dataType.Valid) {
+		if !(column.name.Valid && column.dataType.Valid) {
 			continue
 		}
 
-		columnDef := columnName.String
-
-		if !udtName.Valid {
-			return "", fmt.Errorf("invalid udtName for column %s", columnName.String)
+		columnDef, err := columnDefinition(schema, column)
+		if err != nil {
+			return "", err
 		}
+		columnDefs = append(columnDefs, columnDef)
+	}
 
-		if strings.HasPrefix(udtName.String, "_") {
-			// Array type. example: _text
-			columnDef += " " + udtName.String[1:] + "[]"
-		} else if dataType.String == "USER-DEFINED" && typeSchema.Valid && typeSchema.String != "" {
-			// User-defined type. example: public.text
-			columnDef += " " + typeSchema.String + "." + udtName.String
-		} else {
-			// Standard pg_catalog type. example: int64
-			columnDef += " " + dataType.String
-		}
+	if len(columnDefs) == 0 {
+		return "", fmt.Errorf("Table '%s' not found", tableName)
+	}
 
-		precisionTypes := map[string]bool{
-			"numeric":   true,
-			"decimal":   true,
-			"timestamp": true,
-			"interval":  true,
-		}
+	createTableStmt := fmt.Sprintf("CREATE TABLE %s (\n\t%s\n);", qualifiedName(schema, tableName), strings.Join(columnDefs, ",\n\t"))
 
-		if characterMaximumLength.Valid {
-			columnDef += fmt.Sprintf("(%d)", characterMaximumLength.Int64)
-		} else if precisionTypes[dataType.String] && numericPrecision.Valid {
-			if numericScale.Valid {
-				columnDef += fmt.Sprintf("(%d,%d)", numericPrecision.Int64, numericScale.Int64)
-			} else {
-				columnDef += fmt.Sprintf("(%d)", numericPrecision.Int64)
-			}
-		}
+	return createTableStmt, nil
+}
 
-		if isNullable.String == "NO" {
-			columnDef += " NOT NULL"
-		}
+// columnDefinition returns the definition of a column of a table of the
+// schema, as written in CREATE TABLE.
+func columnDefinition(schema string, column tableColumn) (string, error) {
+	columnName, dataType, udtName, typeSchema := column.name, column.dataType, column.udtName, column.typeSchema
 
-		if columnDefault.Valid {
-			defaultValue := columnDefault.String
-			if strings.Contains(defaultValue, "nextval(") {
-				seqPattern := `nextval\('([^']*)'::regclass\)`
-				re := regexp.MustCompile(seqPattern)
-				defaultValue = re.ReplaceAllStringFunc(defaultValue, func(match string) string {
-					seqName := re.ReplaceAllString(match, "$1")
-					if !strings.Contains(seqName, ".") {
-						seqName = schema + "." + seqName
-					}
-					return fmt.Sprintf("nextval('%s'::regclass)", seqName)
-				})
-			}
-			columnDef += " DEFAULT " + defaultValue
+	columnDef := quoteIdent(columnName.String)
+
+	if !udtName.Valid {
+		return "", fmt.Errorf("invalid udtName for column %s", columnName.String)
+	}
+
+	if strings.HasPrefix(udtName.String, "_") {
+		// Array type. example: _text
+		elementType := quoteIdent(udtName.String[1:])
+		if typeSchema.Valid && typeSchema.String != "" && typeSchema.String != "pg_catalog" {
+			elementType = qualifiedName(typeSchema.String, udtName.String[1:])
 		}
+		columnDef += " " + elementType + "[]"
+	} else if dataType.String == "USER-DEFINED" && typeSchema.Valid && typeSchema.String != "" {
+		// User-defined type. example: public.text
+		columnDef += " " + qualifiedName(typeSchema.String, udtName.String)
+	} else {
+		// Standard pg_catalog type. example: int64
+		columnDef += " " + dataType.String
+	}
 
-		columnDefs = append(columnDefs, columnDef)
+	precisionTypes := map[string]bool{
+		"numeric":   true,
+		"decimal":   true,
+		"timestamp": true,
+		"interval":  true,
 	}
 
-	if len(columnDefs) == 0 {
-		return "", fmt.Errorf("Table '%s' not found", tableName)
+	if column.characterMaximumLength.Valid {
+		columnDef += fmt.Sprintf("(%d)", column.characterMaximumLength.Int64)
+	} else if precisionTypes[dataType.String] && column.numericPrecision.Valid {
+		if column.numericScale.Valid {
+			columnDef += fmt.Sprintf("(%d,%d)", column.numericPrecision.Int64, column.numericScale.Int64)
+		} else {
+			columnDef += fmt.Sprintf("(%d)", column.numericPrecision.Int64)
+		}
 	}
 
-	createTableStmt := fmt.Sprintf("CREATE TABLE %s.%s (\n\t%s\n);", schema, tableName, strings.Join(columnDefs, ",\n\t"))
+	if column.isNullable.String == "NO" {
+		columnDef += " NOT NULL"
+	}
 
-	return createTableStmt, nil
+	// Generated columns are left out of the data records, so they must be
+	// generated again on restore
+	if column.generationExpression.Valid {
+		columnDef += " GENERATED ALWAYS AS (" + column.generationExpression.String + ") STORED"
+	} else if column.columnDefault.Valid {
+		defaultValue := column.columnDefault.String
+		if strings.Contains(defaultValue, "nextval(") {
+			seqPattern := `nextval\('([^']*)'::regclass\)`
+			re := regexp.MustCompile(seqPattern)
+			defaultValue = re.ReplaceAllStringFunc(defaultValue, func(match string) string {
+				seqName := re.ReplaceAllString(match, "$1")
+				if !strings.Contains(seqName, ".") {
+					seqName = quoteIdent(schema) + "." + seqName
+				}
+				return fmt.Sprintf("nextval('%s'::regclass)", seqName)
+			})
+		}
+		columnDef += " DEFAULT " + defaultValue
+	}
+
+	return columnDef, nil
 }
 
-func (m Manager) getPrimaryKeyStatements(tableName string, schema string) (string, error) {
+// getConstraintStatements returns the statements adding the table's
+// constraints of the given types (as in pg_constraint.contype, e.g. 'f' for
+// foreign keys), as defined by the server itself.
+func (m Manager) getConstraintStatements(tableName string, schema string, types []string) (string, error) {
 	var statements []string
 
-	// Get primary keys
-	rows, err := m.Database.Query(`
+	rows, err := m.snapshot.Query(`
 		SELECT
-			kcu.column_name,
-			tc.constraint_name
-		FROM information_schema.table_constraints AS tc 
-		JOIN information_schema.key_column_usage AS kcu
-			ON tc.constraint_name = kcu.constraint_name
-			AND tc.table_schema = kcu.table_schema
-		WHERE tc.constraint_type = 'PRIMARY KEY'
-			AND tc.table_schema=$1
-			AND tc.table_name=$2;	
-	`, schema, tableName)
+			con.conname,
+			pg_catalog.pg_get_constraintdef(con.oid, true) AS definition
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype::text = ANY($3::text[])
+			AND con.conislocal -- Inherited constraints come with the parent table
+			AND n.nspname = $1
+			AND c.relname = $2
+		ORDER BY con.contype, con.conname;
+	`, schema, tableName, types)
 	if err != nil {
 		return "", err
 	}
 	defer rows.Close()
 
-	var (
-		pks            []string
-		constraintName string
-	)
 	for rows.Next() {
-		var pk string
-		err := rows.Scan(&pk, &constraintName)
-		if err != nil {
+		var constraintName, definition string
+		if err := rows.Scan(&constraintName, &definition); err != nil {
 			return "", err
 		}
-		pks = append(pks, pk)
+		statements = append(statements, fmt.Sprintf("ALTER TABLE ONLY %s\n\tADD CONSTRAINT %s %s;",
+			qualifiedName(schema, tableName), quoteIdent(constraintName), definition))
 	}
 
-	if len(pks) > 0 {
-		statements = append(statements, fmt.Sprintf("ALTER TABLE ONLY %s.%s\n\tADD CONSTRAINT %s PRIMARY KEY (%s);", schema, tableName, constraintName, strings.Join(pks, ", ")))
+	if err := rows.Err(); err != nil {
+		return "", err
 	}
 
 	return strings.Join(statements, "\n"), nil
 }
 
-func (m Manager) getForeignKeyStatements(tableName string, schema string) (string, error) {
+// getIndexStatements returns the CREATE INDEX statements of the relation's
+// indexes, except the ones backing a constraint, which are created
+// along with the constraint itself.
+func (m Manager) getIndexStatements(relationName string, schema string) (string, error) {
 	var statements []string
 
-	rows, err := m.Database.Query(`
-		SELECT
-			tc.constraint_name,
-			tc.table_name,
-			kcu.column_name,
-			ccu.table_schema AS foreign_table_schema,
-			ccu.table_name AS foreign_table_name,
-			ccu.column_name AS foreign_column_name 
-		FROM information_schema.table_constraints AS tc 
-		JOIN information_schema.key_column_usage AS kcu
-			ON tc.constraint_name = kcu.constraint_name
-			AND tc.table_schema = kcu.table_schema
-		JOIN information_schema.constraint_column_usage AS ccu
-			ON ccu.constraint_name = tc.constraint_name
-		WHERE tc.constraint_type = 'FOREIGN KEY'
-			AND tc.table_schema=$1
-			AND tc.table_name=$2;
-	`, schema, tableName)
+	rows, err := m.snapshot.Query(`
+		SELECT pg_catalog.pg_get_indexdef(i.indexrelid) AS definition
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_class c ON c.oid = i.indrelid
+		JOIN pg_catalog.pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1
+			AND c.relname = $2
+			AND NOT EXISTS (
+				SELECT 1
+				FROM pg_catalog.pg_constraint con
+				WHERE con.conindid = i.indexrelid
+					AND con.conrelid = i.indrelid
+					AND con.contype IN ('p', 'u', 'x')
+			)
+		ORDER BY ic.relname;
+	`, schema, relationName)
 	if err != nil {
 		return "", err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var constraintName, _tableName, columnName, foreignTableSchema, foreignTableName, foreignColumnName string
-		err := rows.Scan(&constraintName, &_tableName, &columnName, &foreignTableSchema, &foreignTableName, &foreignColumnName)
-		if err != nil {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
 			return "", err
 		}
-		statements = append(statements, fmt.Sprintf("ALTER TABLE ONLY %s.%s\n\tADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s.%s(%s);",
-			schema, _tableName, constraintName, columnName, foreignTableSchema, foreignTableName, foreignColumnName))
+		statements = append(statements, definition+";")
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
 	}
 
 	return strings.Join(statements, "\n"), nil
 }
 
-func (m Manager) getDomainStatements(schema string) (string, error) {
-	result := []string{}
+func (m Manager) getDomainStatements(schema string) ([]packObject, error) {
+	result := []packObject{}
 
 	query := `SELECT
+				t.oid,
 				t.typname AS domain_name,
 				pg_catalog.format_type(t.typbasetype, t.typtypmod) AS data_type,
 				c.conname AS constraint_name,
 				pg_get_constraintdef(c.oid, true) AS check_clause,
-				d.domain_schema AS domain_schema,
+				n.nspname AS domain_schema,
 				pg_catalog.pg_get_userbyid(t.typowner) AS owner
 			FROM pg_catalog.pg_type t
+			JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
 			LEFT JOIN pg_catalog.pg_constraint c ON t.oid = c.contypid
-			INNER JOIN information_schema.domains d ON t.typname = d.domain_name
-			WHERE t.typtype = 'd' AND d.domain_schema = $1
-			ORDER BY domain_name;`
-	rows, err := m.Database.Query(query, schema)
+			WHERE t.typtype = 'd' AND n.nspname = $1
+			ORDER BY domain_name, constraint_name;`
+	rows, err := m.snapshot.Query(query, schema)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
+	type domain struct {
+		OID          uint32
+		Name         string
+		DataType     string
+		Schema       string
+		Owner        string
+		Constraints  []string
+		CheckClauses []string
+	}
+
+	// A domain spans as many rows as it has constraints
+	var domains []*domain
 	for rows.Next() {
 		var (
-			Name           string
-			DataType       string
-			Constraint     string
-			Schema         string
-			Owner          string
-			CheckClauses   []string
+			d              domain
 			constraintName sql.NullString
 			checkClause    sql.NullString
 		)
-		err := rows.Scan(&Name, &DataType, &constraintName, &checkClause, &Schema, &Owner)
+		err := rows.Scan(&d.OID, &d.Name, &d.DataType, &constraintName, &checkClause, &d.Schema, &d.Owner)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		if constraintName.Valid {
-			Constraint = constraintName.String
-		}
-		if checkClause.Valid {
-			CheckClauses = append(CheckClauses, checkClause.String)
+		if len(domains) == 0 || domains[len(domains)-1].OID != d.OID {
+			domains = append(domains, &d)
 		}
 
-		var stmt string
-		stmt += fmt.Sprintf("CREATE DOMAIN %s.%s AS %s", Schema, Name, DataType)
-		for _, clause := range CheckClauses {
-			stmt += fmt.Sprintf("\n    CONSTRAINT %s %s", Constraint, clause)
+		if constraintName.Valid && checkClause.Valid {
+			last := domains[len(domains)-1]
+			last.Constraints = append(last.Constraints, constraintName.String)
+			last.CheckClauses = append(last.CheckClauses, checkClause.String)
 		}
-		stmt += ";\n"
-		stmt += fmt.Sprintf("\nALTER DOMAIN %s.%s OWNER TO %s;", Schema, Name, Owner)
-		result = append(result, stmt)
 	}
 
 	if err = rows.Err(); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return strings.Join(result, "\n\n"), nil
-}
+	for _, d := range domains {
+		var stmt string
+		stmt += fmt.Sprintf("CREATE DOMAIN %s AS %s", qualifiedName(d.Schema, d.Name), d.DataType)
+		for i, clause := range d.CheckClauses {
+			stmt += fmt.Sprintf("\n    CONSTRAINT %s %s", quoteIdent(d.Constraints[i]), clause)
+		}
+		stmt += ";\n"
+		stmt += fmt.Sprintf("\nALTER DOMAIN %s OWNER TO %s;", qualifiedName(d.Schema, d.Name), quoteIdent(d.Owner))
+
+		result = append(result, packObject{
+			Key:       objectKey{"pg_type", d.OID},
+			Type:      "DOMAIN",
+			Schema:    d.Schema,
+			Name:      d.Name,
+			Statement: stmt,
+		})
+	}
 
-func (m Manager) getFunctionStatements(schema string) (string, error) {
-	result := []string{}
+	return result, nil
+}
 
+// getFunctionStatements returns the functions, procedures and aggregates of
+// the schema. Functions and procedures are defined by the server itself, so
+// that every attribute of theirs (SECURITY DEFINER, SET clauses, COST, ...)
+// and their body come out as they are. Aggregates are assembled from pg_aggregate.
+func (m Manager) getFunctionStatements(schema string) ([]packObject, error) {
 	query := `SELECT
-					n.nspname AS schema_name,
-					p.proname AS function_name,
-					p.provolatile AS volatile,
-					p.proisstrict AS strict,
-					pg_catalog.pg_get_function_arguments(p.oid) AS argument_types,
-					pg_catalog.pg_get_function_result(p.oid) AS return_type,
-					pg_catalog.pg_get_userbyid(p.proowner) AS owner,
-					p.prosrc AS body,
-					l.lanname AS language
+				p.oid,
+				n.nspname AS schema_name,
+				p.proname AS function_name,
+				p.prokind::text AS kind,
+				pg_catalog.pg_get_function_identity_arguments(p.oid) AS identity_arguments,
+				pg_catalog.pg_get_userbyid(p.proowner) AS owner,
+				CASE WHEN p.prokind <> 'a' THEN pg_catalog.pg_get_functiondef(p.oid) END AS definition
 			FROM pg_catalog.pg_proc p
 			JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
-			JOIN pg_catalog.pg_language l ON l.oid = p.prolang
-			WHERE pg_catalog.pg_function_is_visible(p.oid)
-			AND n.nspname = $1
-			AND p.prokind = 'f' -- Only select normal functions
-			ORDER BY schema_name, function_name;`
-	rows, err := m.Database.Query(query, schema)
+			WHERE n.nspname = $1
+				-- Functions created along with another object (e.g. range constructors)
+				AND NOT EXISTS (
+					SELECT 1
+					FROM pg_catalog.pg_depend d
+					WHERE d.classid = 'pg_catalog.pg_proc'::regclass
+						AND d.objid = p.oid
+						AND d.deptype = 'i'
+				)
+			ORDER BY schema_name, function_name, identity_arguments;`
+	rows, err := m.snapshot.Query(query, schema)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
+	type functionRow struct {
+		oid                                     uint32
+		schema, name, kind, identityArgs, owner string
+		definition                              sql.NullString
+	}
+
+	// Read upfront as in getCreateTypeStatements, aggregates take further queries
+	var functionRows []functionRow
 	for rows.Next() {
-		var (
-			Name          string
-			Schema        string
-			ArgumentTypes string
-			ReturnType    string
-			Owner         string
-			Language      string
-			Body          string
-			Volatile      string
-			IsStrict      bool
-		)
-		err := rows.Scan(&Schema, &Name, &Volatile, &IsStrict, &ArgumentTypes, &ReturnType, &Owner, &Body, &Language)
+		var f functionRow
+		err := rows.Scan(&f.oid, &f.schema, &f.name, &f.kind, &f.identityArgs, &f.owner, &f.definition)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		functionRows = append(functionRows, f)
+	}
 
-		switch Volatile {
-		case "i":
-			Volatile = "IMMUTABLE"
-		case "v":
-			Volatile = "VOLATILE"
-		case "s":
-			Volatile = "STABLE"
-		default:
-			Volatile = ""
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	result := []packObject{}
+	for _, f := range functionRows {
+		kind := "FUNCTION"
+		switch f.kind {
+		case "p":
+			kind = "PROCEDURE"
+		case "a":
+			kind = "AGGREGATE"
 		}
 
-		var stmt string
-		Separator := "$_$"
+		signature := fmt.Sprintf("%s(%s)", qualifiedName(f.schema, f.name), f.identityArgs)
 
-		if Language == "plpgsql" {
-			Separator = "$$"
+		var stmt string
+		if f.kind == "a" {
+			stmt, err = m.getCreateAggregateStatement(f.oid, signature)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			stmt = strings.TrimSpace(f.definition.String) + ";\n"
 		}
-		stmt += fmt.Sprintf("CREATE FUNCTION %s.%s(%s) RETURNS %s", Schema, Name, ArgumentTypes, ReturnType)
-		stmt += fmt.Sprintf("\n\tLANGUAGE %s %s %s", Language, Volatile, (map[bool]string{true: "STRICT", false: ""})[IsStrict])
-		stmt += fmt.Sprintf("\nAS %s\n%s\n%s", Separator, Body, Separator)
 
-		stmt += ";\n"
-		stmt += fmt.Sprintf("\nALTER FUNCTION %s.%s(%s) OWNER TO %s;", Schema, Name, ArgumentTypes, Owner)
-		result = append(result, stmt)
+		stmt += fmt.Sprintf("\nALTER %s %s OWNER TO %s;", kind, signature, quoteIdent(f.owner))
+		result = append(result, packObject{
+			Key:       objectKey{"pg_proc", f.oid},
+			Type:      kind,
+			Schema:    f.schema,
+			Name:      fmt.Sprintf("%s(%s)", f.name, f.identityArgs),
+			Statement: stmt,
+		})
 	}
 
-	if err = rows.Err(); err != nil {
+	return result, nil
+}
+
+// getCreateAggregateStatement returns the CREATE AGGREGATE statement of
+// the aggregate with the given OID and signature.
+func (m Manager) getCreateAggregateStatement(oid uint32, signature string) (string, error) {
+	var (
+		kind, finalModify, parallel                        string
+		transFunction, transType                           string
+		transSpace, movingTransSpace                       int32
+		finalExtra, movingFinalExtra                       bool
+		movingFinalModify                                  string
+		finalFunction, combineFunction                     sql.NullString
+		serialFunction, deserialFunction                   sql.NullString
+		movingTransFunction, movingInverseFunction         sql.NullString
+		movingTransType, movingFinalFunction, sortOperator sql.NullString
+		initialValue, movingInitialValue                   sql.NullString
+	)
+
+	err := m.snapshot.QueryRow(`
+		SELECT
+			a.aggkind::text,
+			a.aggtransfn::text,
+			pg_catalog.format_type(a.aggtranstype, NULL),
+			a.aggtransspace,
+			NULLIF(a.aggfinalfn::oid, 0)::regproc::text,
+			a.aggfinalextra,
+			a.aggfinalmodify::text,
+			NULLIF(a.aggcombinefn::oid, 0)::regproc::text,
+			NULLIF(a.aggserialfn::oid, 0)::regproc::text,
+			NULLIF(a.aggdeserialfn::oid, 0)::regproc::text,
+			a.agginitval,
+			NULLIF(a.aggmtransfn::oid, 0)::regproc::text,
+			NULLIF(a.aggminvtransfn::oid, 0)::regproc::text,
+			CASE WHEN a.aggmtranstype <> 0 THEN pg_catalog.format_type(a.aggmtranstype, NULL) END,
+			a.aggmtransspace,
+			NULLIF(a.aggmfinalfn::oid, 0)::regproc::text,
+			a.aggmfinalextra,
+			a.aggmfinalmodify::text,
+			a.aggminitval,
+			NULLIF(a.aggsortop, 0)::regoper::text,
+			p.proparallel::text
+		FROM pg_catalog.pg_aggregate a
+		JOIN pg_catalog.pg_proc p ON p.oid = a.aggfnoid
+		WHERE a.aggfnoid = $1;
+	`, oid).Scan(&kind, &transFunction, &transType, &transSpace, &finalFunction, &finalExtra, &finalModify,
+		&combineFunction, &serialFunction, &deserialFunction, &initialValue,
+		&movingTransFunction, &movingInverseFunction, &movingTransType, &movingTransSpace,
+		&movingFinalFunction, &movingFinalExtra, &movingFinalModify, &movingInitialValue, &sortOperator, &parallel)
+	if err != nil {
 		return "", err
 	}
 
-	return strings.Join(result, "\n\n"), nil
+	finalModes := map[string]string{"r": "READ_ONLY", "s": "SHAREABLE", "w": "READ_WRITE"}
+
+	options := []string{"SFUNC = " + transFunction, "STYPE = " + transType}
+	if transSpace != 0 {
+		options = append(options, fmt.Sprintf("SSPACE = %d", transSpace))
+	}
+	if finalFunction.Valid {
+		options = append(options, "FINALFUNC = "+finalFunction.String)
+		if finalExtra {
+			options = append(options, "FINALFUNC_EXTRA")
+		}
+		options = append(options, "FINALFUNC_MODIFY = "+finalModes[finalModify])
+	}
+	if combineFunction.Valid {
+		options = append(options, "COMBINEFUNC = "+combineFunction.String)
+	}
+	if serialFunction.Valid {
+		options = append(options, "SERIALFUNC = "+serialFunction.String)
+	}
+	if deserialFunction.Valid {
+		options = append(options, "DESERIALFUNC = "+deserialFunction.String)
+	}
+	if initialValue.Valid {
+		options = append(options, "INITCOND = "+quoteLiteral(initialValue.String))
+	}
+	if movingTransFunction.Valid {
+		options = append(options,
+			"MSFUNC = "+movingTransFunction.String,
+			"MINVFUNC = "+movingInverseFunction.String,
+			"MSTYPE = "+movingTransType.String)
+		if movingTransSpace != 0 {
+			options = append(options, fmt.Sprintf("MSSPACE = %d", movingTransSpace))
+		}
+		if movingFinalFunction.Valid {
+			options = append(options, "MFINALFUNC = "+movingFinalFunction.String)
+			if movingFinalExtra {
+				options = append(options, "MFINALFUNC_EXTRA")
+			}
+			options = append(options, "MFINALFUNC_MODIFY = "+finalModes[movingFinalModify])
+		}
+		if movingInitialValue.Valid {
+			options = append(options, "MINITCOND = "+quoteLiteral(movingInitialValue.String))
+		}
+	}
+	if sortOperator.Valid {
+		options = append(options, "SORTOP = OPERATOR("+sortOperator.String+")")
+	}
+	if kind == "h" {
+		options = append(options, "HYPOTHETICAL")
+	}
+	switch parallel {
+	case "s":
+		options = append(options, "PARALLEL = SAFE")
+	case "r":
+		options = append(options, "PARALLEL = RESTRICTED")
+	}
+
+	return fmt.Sprintf("CREATE AGGREGATE %s (\n\t%s\n);\n", signature, strings.Join(options, ",\n\t")), nil
 }
 
-func (m Manager) getSequenceStatements(schema string) (string, error) {
-	var sequenceStatements []string
+func (m Manager) getSequenceStatements(schema string) ([]packObject, error) {
+	var sequenceStatements []packObject
 
 	query := `
-	SELECT s.sequence_name,
+	SELECT c.oid,
+		s.sequence_name,
 		s.sequence_schema,
 		s.start_value,
 		s.minimum_value,
@@ -714,14 +1190,15 @@ func (m Manager) getSequenceStatements(schema string) (string, error) {
 	WHERE s.sequence_schema =$1;
 	`
 
-	rows, err := m.Database.Query(query, schema)
+	rows, err := m.snapshot.Query(query, schema)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var (
+			oid          uint32
 			name         string
 			startValue   int64
 			minimumValue int64
@@ -732,9 +1209,9 @@ func (m Manager) getSequenceStatements(schema string) (string, error) {
 			owner        string
 		)
 
-		err := rows.Scan(&name, &schema, &startValue, &minimumValue, &maximumValue, &increment, &cycleOption, &owner)
+		err := rows.Scan(&oid, &name, &schema, &startValue, &minimumValue, &maximumValue, &increment, &cycleOption, &owner)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		cycle := ""
@@ -752,25 +1229,35 @@ func (m Manager) getSequenceStatements(schema string) (string, error) {
 			maxvalueClause = "\n\tNO MAXVALUE"
 		}
 
-		createStmt := fmt.Sprintf("CREATE SEQUENCE %s.%s\n\tSTART WITH %d%s%s\n\tINCREMENT BY %d%s\n;\n",
-			schema, name, startValue, minvalueClause, maxvalueClause, increment, cycle)
+		createStmt := fmt.Sprintf("CREATE SEQUENCE %s\n\tSTART WITH %d%s%s\n\tINCREMENT BY %d%s\n;\n",
+			qualifiedName(schema, name), startValue, minvalueClause, maxvalueClause, increment, cycle)
 
-		alterStmt := fmt.Sprintf("ALTER SEQUENCE %s.%s OWNER TO %s;", schema, name, owner)
+		alterStmt := fmt.Sprintf("ALTER SEQUENCE %s OWNER TO %s;", qualifiedName(schema, name), quoteIdent(owner))
 
-		sequenceStatements = append(sequenceStatements, createStmt+"\n"+alterStmt)
+		sequenceStatements = append(sequenceStatements, packObject{
+			Key:       objectKey{"pg_class", oid},
+			Type:      "SEQUENCE",
+			Schema:    schema,
+			Name:      name,
+			Statement: createStmt + "\n" + alterStmt,
+		})
 	}
 
 	if err = rows.Err(); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	result := strings.Join(sequenceStatements, "\n\n")
-	return result, nil
+	return sequenceStatements, nil
 }
 
-func (m Manager) getCreateTypeStatements(schema string) (string, error) {
+// getCreateTypeStatements returns the enum, composite, range and base types
+// of the schema. Array and multirange types are created along with their
+// element and range types. Base types come with a shell type, which their
+// I/O functions are created against before the type itself is.
+func (m Manager) getCreateTypeStatements(schema string) ([]packObject, error) {
 	query := `
                 SELECT
+                        t.oid,
                         t.typname,
                         n.nspname,
                         pg_catalog.pg_get_userbyid(t.typowner) as owner,
@@ -778,45 +1265,88 @@ func (m Manager) getCreateTypeStatements(schema string) (string, error) {
                 FROM
                         pg_catalog.pg_type t
                         LEFT JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+                        LEFT JOIN pg_catalog.pg_class c ON c.oid = t.typrelid
                 WHERE
                         (n.nspname = $1 OR $1 = '')
-                        AND t.typtype = 'e' -- Temporarily, select only enum types
-						-- TODO: Add support for other types (range, composite, etc)
-                        AND t.typisdefined = true;
+                        AND (t.typtype IN ('e', 'r', 'b') OR t.typtype = 'c' AND c.relkind = 'c')
+                        AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_type e WHERE e.typarray = t.oid)
+                        AND t.typisdefined = true
+                ORDER BY t.typname;
         `
-	rows, err := m.Database.Query(query, schema)
+	rows, err := m.snapshot.Query(query, schema)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
-	typeDefinitions := make([]string, 0)
+	type typeRow struct {
+		oid                                      uint32
+		typeName, typeSchema, typeOwner, typtype string
+	}
+
+	// The rows are read upfront, as no other query can run on the snapshot
+	// transaction while they are open.
+	var typeRows []typeRow
 	for rows.Next() {
-		var typeName, typeSchema, typeOwner, typtype string
-		err := rows.Scan(&typeName, &typeSchema, &typeOwner, &typtype)
+		var t typeRow
+		err := rows.Scan(&t.oid, &t.typeName, &t.typeSchema, &t.typeOwner, &t.typtype)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		typeRows = append(typeRows, t)
+	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	typeDefinitions := make([]packObject, 0)
+	for _, t := range typeRows {
 		var createTypeStmt string
-		switch typtype {
+		switch t.typtype {
 		case "e": // Enum type
-			createTypeStmt, err = m.getCreateEnumTypeStatement(typeName, typeSchema)
-			if err != nil {
-				return "", err
-			}
-
+			createTypeStmt, err = m.getCreateEnumTypeStatement(t.typeName, t.typeSchema)
+		case "c": // Composite type
+			createTypeStmt, err = m.getCreateCompositeTypeStatement(t.oid, t.typeName, t.typeSchema)
+		case "r": // Range type
+			createTypeStmt, err = m.getCreateRangeTypeStatement(t.oid, t.typeName, t.typeSchema)
+		case "b": // Base type
+			createTypeStmt, err = m.getCreateBaseTypeStatement(t.oid, t.typeName, t.typeSchema)
+
+			typeDefinitions = append(typeDefinitions, packObject{
+				Key:       shellTypeKey(t.oid),
+				Type:      "SHELL TYPE",
+				Schema:    t.typeSchema,
+				Name:      t.typeName,
+				Statement: fmt.Sprintf("CREATE TYPE %s;", qualifiedName(t.typeSchema, t.typeName)),
+			})
 		default:
 			continue
 		}
+		if err != nil {
+			return nil, err
+		}
 
-		typeDefinitions = append(typeDefinitions, createTypeStmt)
-	}
+		createTypeStmt += fmt.Sprintf("\n\nALTER TYPE %s OWNER TO %s;", qualifiedName(t.typeSchema, t.typeName), quoteIdent(t.typeOwner))
 
-	if err := rows.Err(); err != nil {
-		return "", err
+		typeDefinitions = append(typeDefinitions, packObject{
+			Key:       objectKey{"pg_type", t.oid},
+			Type:      "TYPE",
+			Schema:    t.typeSchema,
+			Name:      t.typeName,
+			Statement: createTypeStmt,
+		})
 	}
-	return strings.Join(typeDefinitions, "\n"), nil
+
+	return typeDefinitions, nil
+}
+
+// shellTypeKey returns the key of the shell type standing in for a base type
+// until its I/O functions exist. Shell types share the OID of their base type,
+// the catalog of their key sets them apart.
+func shellTypeKey(oid uint32) objectKey {
+	return objectKey{"pg_type (shell)", oid}
 }
 
 func (m Manager) getCreateEnumTypeStatement(typeName string, schema string) (string, error) {
@@ -832,7 +1362,7 @@ func (m Manager) getCreateEnumTypeStatement(typeName string, schema string) (str
                 ORDER BY
                         e.enumsortorder;
         `
-	rows, err := m.Database.Query(query, typeName, schema)
+	rows, err := m.snapshot.Query(query, typeName, schema)
 	if err != nil {
 		return "", err
 	}
@@ -844,7 +1374,7 @@ func (m Manager) getCreateEnumTypeStatement(typeName string, schema string) (str
 		if err := rows.Scan(&label); err != nil {
 			return "", err
 		}
-		labels = append(labels, fmt.Sprintf("\t'%s'", label))
+		labels = append(labels, "\t"+quoteLiteral(label))
 	}
 
 	if err := rows.Err(); err != nil {
@@ -852,173 +1382,417 @@ func (m Manager) getCreateEnumTypeStatement(typeName string, schema string) (str
 	}
 
 	enumLabels := strings.Join(labels, ", \n")
-	createTypeStmt := fmt.Sprintf("CREATE TYPE %s.%s AS ENUM (\n%s\n);", schema, typeName, enumLabels)
+	createTypeStmt := fmt.Sprintf("CREATE TYPE %s AS ENUM (\n%s\n);", qualifiedName(schema, typeName), enumLabels)
 	return createTypeStmt, nil
 }
 
-func (m Manager) broadcastTableRecordsINSERT(tableName string, schema string, ch chan string) error {
-	go func() {
-		selectDataSQL := fmt.Sprintf("SELECT * FROM %s.%s", schema, tableName)
-		rows, err := m.Database.Query(selectDataSQL)
-		if err != nil {
-			// return fmt.Errorf("error while fetching data: %v", err)
-			return
-		}
-
-		defer rows.Close()
-		defer close(ch)
+// getCreateCompositeTypeStatement returns the CREATE TYPE statement of a
+// composite type, i.e. a row type not tied to a table.
+func (m Manager) getCreateCompositeTypeStatement(oid uint32, typeName string, schema string) (string, error) {
+	query := `
+                SELECT
+                        a.attname,
+                        pg_catalog.format_type(a.atttypid, a.atttypmod),
+                        CASE WHEN a.attcollation <> at.typcollation THEN co.collname END,
+                        cn.nspname
+                FROM
+                        pg_catalog.pg_type t
+                        JOIN pg_catalog.pg_attribute a ON a.attrelid = t.typrelid
+                        JOIN pg_catalog.pg_type at ON at.oid = a.atttypid
+                        LEFT JOIN pg_catalog.pg_collation co ON co.oid = a.attcollation
+                        LEFT JOIN pg_catalog.pg_namespace cn ON cn.oid = co.collnamespace
+                WHERE
+                        t.oid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+                ORDER BY
+                        a.attnum;
+        `
+	rows, err := m.snapshot.Query(query, oid)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
 
-		columnNames, err := rows.Columns()
-		if err != nil {
-			// return fmt.Errorf("error while fetching columns: %v", err)
-			return
+	attributes := make([]string, 0)
+	for rows.Next() {
+		var (
+			name, dataType             string
+			collation, collationSchema sql.NullString
+		)
+		if err := rows.Scan(&name, &dataType, &collation, &collationSchema); err != nil {
+			return "", err
 		}
 
-		values := make([]interface{}, len(columnNames))
-		valuePointers := make([]interface{}, len(columnNames))
-		for i := range columnNames {
-			valuePointers[i] = &values[i]
+		attribute := fmt.Sprintf("\t%s %s", quoteIdent(name), dataType)
+		if collation.Valid {
+			attribute += " COLLATE " + qualifiedName(collationSchema.String, collation.String)
 		}
+		attributes = append(attributes, attribute)
+	}
 
-		for rows.Next() {
-			err := rows.Scan(valuePointers...)
-			if err != nil {
-				return
-			}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
 
-			insertStmt := fmt.Sprintf("INSERT INTO %s.%s (%s) VALUES (",
-				schema, tableName, strings.Join(columnNames, ", "))
-
-			for i, value := range values {
-				if value == nil {
-					insertStmt += "NULL"
-				} else {
-					strValue := fmt.Sprintf("%v", value)
-					switch value.(type) {
-					case int, int64, float64:
-						insertStmt += strValue
-					case bool:
-						if value.(bool) {
-							insertStmt += "TRUE"
-						} else {
-							insertStmt += "FALSE"
-						}
-					case string:
-						insertStmt += fmt.Sprintf("'%v'", strings.ReplaceAll(strValue, "'", "''"))
-					case time.Time:
-						t, err := time.Parse("2006-01-02 15:04:05 -0700 -0700", strValue)
-						// t, err := value.(time.Time)
-						if err != nil {
-							continue
-						}
-
-						h, m, d := t.Clock()
-						// TODO: This is a faulty way of checking whether 't' is of type 'time' or 'date'
-						if h+m+d != 0 {
-							// (likely) time
-							insertStmt += fmt.Sprintf("'%s'", t.Format("2006-01-02 15:04:05"))
-						} else {
-							// date
-							insertStmt += fmt.Sprintf("'%s'", t.Format("2006-01-02"))
-						}
-					default:
-						insertStmt += fmt.Sprintf("'%s'", strValue)
-					}
-				}
+	return fmt.Sprintf("CREATE TYPE %s AS (\n%s\n);", qualifiedName(schema, typeName), strings.Join(attributes, ",\n")), nil
+}
 
-				if i != len(values)-1 {
-					insertStmt += ", "
-				}
-			}
+// getCreateRangeTypeStatement returns the CREATE TYPE statement of a range
+// type, which creates its multirange type as well (PostgreSQL 14 and later).
+func (m Manager) getCreateRangeTypeStatement(oid uint32, typeName string, schema string) (string, error) {
+	var (
+		subtype, opclass, opclassSchema           string
+		collation, collationSchema, canonical     sql.NullString
+		subtypeDiff, multirange, multirangeSchema sql.NullString
+	)
+
+	// rngmultitypid is missing from servers older than PostgreSQL 14, so it
+	// is read through to_jsonb
+	err := m.snapshot.QueryRow(`
+		SELECT
+			pg_catalog.format_type(r.rngsubtype, NULL),
+			opc.opcname,
+			opcn.nspname,
+			co.collname,
+			con.nspname,
+			NULLIF(r.rngcanonical::oid, 0)::regproc::text,
+			NULLIF(r.rngsubdiff::oid, 0)::regproc::text,
+			mt.typname,
+			mtn.nspname
+		FROM pg_catalog.pg_range r
+		JOIN pg_catalog.pg_opclass opc ON opc.oid = r.rngsubopc
+		JOIN pg_catalog.pg_namespace opcn ON opcn.oid = opc.opcnamespace
+		LEFT JOIN pg_catalog.pg_collation co ON co.oid = r.rngcollation
+		LEFT JOIN pg_catalog.pg_namespace con ON con.oid = co.collnamespace
+		LEFT JOIN pg_catalog.pg_type mt ON mt.oid = (pg_catalog.to_jsonb(r) ->> 'rngmultitypid')::oid
+		LEFT JOIN pg_catalog.pg_namespace mtn ON mtn.oid = mt.typnamespace
+		WHERE r.rngtypid = $1;
+	`, oid).Scan(&subtype, &opclass, &opclassSchema, &collation, &collationSchema, &canonical, &subtypeDiff, &multirange, &multirangeSchema)
+	if err != nil {
+		return "", err
+	}
+
+	options := []string{
+		"SUBTYPE = " + subtype,
+		"SUBTYPE_OPCLASS = " + qualifiedName(opclassSchema, opclass),
+	}
+	if collation.Valid {
+		options = append(options, "COLLATION = "+qualifiedName(collationSchema.String, collation.String))
+	}
+	if canonical.Valid {
+		options = append(options, "CANONICAL = "+canonical.String)
+	}
+	if subtypeDiff.Valid {
+		options = append(options, "SUBTYPE_DIFF = "+subtypeDiff.String)
+	}
+	if multirange.Valid {
+		options = append(options, "MULTIRANGE_TYPE_NAME = "+qualifiedName(multirangeSchema.String, multirange.String))
+	}
+
+	return fmt.Sprintf("CREATE TYPE %s AS RANGE (\n\t%s\n);", qualifiedName(schema, typeName), strings.Join(options, ",\n\t")), nil
+}
+
+// getCreateBaseTypeStatement returns the CREATE TYPE statement of a base
+// type, to be run once its shell type and I/O functions exist.
+func (m Manager) getCreateBaseTypeStatement(oid uint32, typeName string, schema string) (string, error) {
+	var (
+		input, output, alignment, storage, category, delimiter string
+		length                                                 int16
+		byValue, preferred, collatable                         bool
+		receive, send, modifierInput, modifierOutput           sql.NullString
+		analyze, subscript, element, defaultValue              sql.NullString
+	)
+
+	// typsubscript is missing from servers older than PostgreSQL 14, so it
+	// is read through to_jsonb
+	err := m.snapshot.QueryRow(`
+		SELECT
+			t.typinput::text,
+			t.typoutput::text,
+			NULLIF(t.typreceive::oid, 0)::regproc::text,
+			NULLIF(t.typsend::oid, 0)::regproc::text,
+			NULLIF(t.typmodin::oid, 0)::regproc::text,
+			NULLIF(t.typmodout::oid, 0)::regproc::text,
+			NULLIF(t.typanalyze::oid, 0)::regproc::text,
+			NULLIF(pg_catalog.to_jsonb(t) ->> 'typsubscript', '-'),
+			t.typlen,
+			t.typbyval,
+			t.typalign::text,
+			t.typstorage::text,
+			t.typcategory::text,
+			t.typispreferred,
+			t.typdefault,
+			CASE WHEN t.typelem <> 0 THEN pg_catalog.format_type(t.typelem, NULL) END,
+			t.typdelim::text,
+			t.typcollation <> 0
+		FROM pg_catalog.pg_type t
+		WHERE t.oid = $1;
+	`, oid).Scan(&input, &output, &receive, &send, &modifierInput, &modifierOutput, &analyze, &subscript,
+		&length, &byValue, &alignment, &storage, &category, &preferred, &defaultValue, &element, &delimiter, &collatable)
+	if err != nil {
+		return "", err
+	}
 
-			insertStmt += ");\n"
-			ch <- insertStmt
+	options := []string{"INPUT = " + input, "OUTPUT = " + output}
+	for _, function := range []struct {
+		option string
+		name   sql.NullString
+	}{
+		{"RECEIVE", receive},
+		{"SEND", send},
+		{"TYPMOD_IN", modifierInput},
+		{"TYPMOD_OUT", modifierOutput},
+		{"ANALYZE", analyze},
+		{"SUBSCRIPT", subscript},
+	} {
+		if function.name.Valid {
+			options = append(options, function.option+" = "+function.name.String)
 		}
+	}
 
-	}()
-	return nil
+	if length == -1 {
+		options = append(options, "INTERNALLENGTH = VARIABLE")
+	} else {
+		options = append(options, fmt.Sprintf("INTERNALLENGTH = %d", length))
+	}
+	if byValue {
+		options = append(options, "PASSEDBYVALUE")
+	}
+
+	alignments := map[string]string{"c": "char", "s": "int2", "i": "int4", "d": "double"}
+	storages := map[string]string{"p": "plain", "e": "external", "x": "extended", "m": "main"}
+	options = append(options,
+		"ALIGNMENT = "+alignments[alignment],
+		"STORAGE = "+storages[storage],
+		"CATEGORY = "+quoteLiteral(category))
+
+	if preferred {
+		options = append(options, "PREFERRED = true")
+	}
+	if defaultValue.Valid {
+		options = append(options, "DEFAULT = "+quoteLiteral(defaultValue.String))
+	}
+	if element.Valid {
+		options = append(options, "ELEMENT = "+element.String)
+	}
+	if delimiter != "," {
+		options = append(options, "DELIMITER = "+quoteLiteral(delimiter))
+	}
+	if collatable {
+		options = append(options, "COLLATABLE = true")
+	}
+
+	return fmt.Sprintf("CREATE TYPE %s (\n\t%s\n);", qualifiedName(schema, typeName), strings.Join(options, ",\n\t")), nil
 }
 
-func (m Manager) broadcastTableRecordsCOPY(tableName string, schema string, ch chan string) error {
+// writeTableRecords writes the data records of a single table to w
+// using the configured record mode. Canceling ctx stops the fetching.
+func (m Manager) writeTableRecords(ctx context.Context, w io.Writer, tableName string, schema string) error {
+	if _, err := io.WriteString(w, "\n-- Table: "+commentText(qualifiedName(schema, tableName))+"\n"); err != nil {
+		return fmt.Errorf("error while writing data records: %v", err)
+	}
+
+	predicate := m.getTablePredicate(tableName, schema)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan string)
+	errs := make(chan error, 1)
+
 	go func() {
-		selectDataSQL := fmt.Sprintf("SELECT * FROM %s.%s", schema, tableName)
-		rows, err := m.Database.Query(selectDataSQL)
-		if err != nil {
-			return
-		}
-		defer rows.Close()
 		defer close(ch)
 
-		columnNames, err := rows.Columns()
-		if err != nil {
-			return
+		switch m.Options.RecordMode {
+		case "insert":
+			errs <- m.broadcastTableRecordsINSERT(ctx, tableName, schema, predicate, ch)
+		case "copy":
+			errs <- m.broadcastTableRecordsCOPY(ctx, tableName, schema, predicate, ch)
 		}
+	}()
 
-		values := make([]interface{}, len(columnNames))
-		valuePointers := make([]interface{}, len(columnNames))
-		for i := range columnNames {
-			valuePointers[i] = &values[i]
+	// Keep draining the channel after a failed write so that
+	// the broadcasting goroutine is able to finish and release its rows.
+	var writeErr error
+	for record := range ch {
+		if writeErr != nil {
+			continue
 		}
+		if _, writeErr = io.WriteString(w, record); writeErr != nil {
+			cancel()
+		}
+	}
 
-		ch <- fmt.Sprintf("COPY %s.%s (%s) FROM stdin;\n",
-			schema, tableName, strings.Join(columnNames, ", "))
+	if writeErr != nil {
+		return fmt.Errorf("error while writing data records: %v", writeErr)
+	}
 
-		for rows.Next() {
-			err := rows.Scan(valuePointers...)
-			if err != nil {
-				return
-			}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("error while fetching data records: %v", err)
+	}
+
+	return nil
+}
+
+// broadcastTableRecordsINSERT sends the data records of the table satisfying
+// the predicate to ch as INSERT statements. It runs alongside writeTableRecords,
+// which drains ch, and returns once every record is sent.
+func (m Manager) broadcastTableRecordsINSERT(ctx context.Context, tableName string, schema string, predicate string, ch chan string) error {
+	columnNames, err := m.getColumnNames(tableName, schema)
+	if err != nil {
+		return fmt.Errorf("cannot fetch columns: %v", err)
+	}
+
+	masks := m.getColumnMasks(tableName, schema, columnNames)
+
+	columns := strings.Join(quoteIdents(columnNames), ", ")
+
+	selectDataSQL := fmt.Sprintf("SELECT %s FROM %s", columns, qualifiedName(schema, tableName))
+	if predicate != "" {
+		selectDataSQL += " WHERE " + predicate
+	}
+
+	// Values are read in the text format of the server, which every type
+	// round-trips through, and written as literals based on their type.
+	return m.conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+		result := pgConn.ExecParams(ctx, selectDataSQL, nil, nil, nil, nil)
 
-			valueParams := []string{}
-
-			for _, value := range values {
-				if value == nil {
-					valueParams = append(valueParams, "NULL")
-				} else {
-					strValue := fmt.Sprintf("%v", value)
-					switch value.(type) {
-					case int, int64, float64:
-						valueParams = append(valueParams, strValue)
-					case bool:
-						if value.(bool) {
-							valueParams = append(valueParams, "TRUE")
-						} else {
-							valueParams = append(valueParams, "FALSE")
-						}
-					case string:
-						valueParams = append(valueParams, fmt.Sprintf("'%v'", strings.ReplaceAll(strValue, "'", "''")))
-					case time.Time:
-						t, err := time.Parse("2006-01-02 15:04:05 -0700 -0700", strValue)
-						// t, err := value.(time.Time)
-						if err != nil {
-							continue
-						}
-
-						h, m, d := t.Clock()
-						// TODO: This is a faulty way of checking whether 't' is of type 'time' or 'date'
-						if h+m+d != 0 {
-							// (likely) time
-							valueParams = append(valueParams, fmt.Sprintf("'%s'", t.Format("2006-01-02 15:04:05")))
-						} else {
-							// date
-							valueParams = append(valueParams, fmt.Sprintf("'%s'", t.Format("2006-01-02")))
-						}
-					default:
-						valueParams = append(valueParams, fmt.Sprintf("'%s'", strValue))
+		insertPrefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES (", qualifiedName(renamedSchema(schema, m.Options.RenameSchemas), tableName), columns)
+		fields := result.FieldDescriptions()
+
+		for result.NextRow() {
+			var insertStmt strings.Builder
+			insertStmt.WriteString(insertPrefix)
+
+			for i, value := range result.Values() {
+				if i > 0 {
+					insertStmt.WriteString(", ")
+				}
+
+				if masks != nil && masks[i] != nil && value != nil {
+					if masked := masks[i](string(value)); masked != nil {
+						insertStmt.WriteString(quoteLiteral(*masked))
+					} else {
+						insertStmt.WriteString("NULL")
 					}
+					continue
 				}
 
-				// if i != len(values)-1 {
-				// 	valueParams = append(valueParams, ", ")
-				// }
+				insertStmt.WriteString(formatLiteral(value, fields[i].DataTypeOID))
 			}
 
-			ch <- strings.Join(valueParams, "\t")
-			ch <- "\n"
+			insertStmt.WriteString(");\n")
+			ch <- insertStmt.String()
 		}
 
-		ch <- "\\.\n"
+		_, err := result.Close()
+		return err
+	})
+}
 
-	}()
+// formatLiteral returns the SQL literal of a value given in the text format
+// of the server, nil standing for NULL. Numbers and booleans are written as
+// they are, as long as they are finite. Every other value is written as a
+// string literal, which the server casts to the type of its column on insert.
+func formatLiteral(value []byte, typeOID uint32) string {
+	if value == nil {
+		return "NULL"
+	}
+
+	switch typeOID {
+	case pgtype.BoolOID:
+		if string(value) == "t" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return string(value)
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		// NaN and infinities are only valid as string literals
+		switch string(value) {
+		case "NaN", "Infinity", "-Infinity":
+			return quoteLiteral(string(value))
+		}
+		return string(value)
+	}
+
+	return quoteLiteral(string(value))
+}
+
+// broadcastTableRecordsCOPY sends the data records of the table satisfying
+// the predicate to ch as a COPY block. It runs alongside writeTableRecords,
+// which drains ch, and returns once every record is sent.
+func (m Manager) broadcastTableRecordsCOPY(ctx context.Context, tableName string, schema string, predicate string, ch chan string) error {
+	columnNames, err := m.getColumnNames(tableName, schema)
+	if err != nil {
+		return fmt.Errorf("cannot fetch columns: %v", err)
+	}
+
+	table, columns := qualifiedName(schema, tableName), strings.Join(quoteIdents(columnNames), ", ")
+
+	ch <- fmt.Sprintf("COPY %s (%s) FROM stdin;\n", qualifiedName(renamedSchema(schema, m.Options.RenameSchemas), tableName), columns)
+
+	// Let the server serialize the records itself, so the data
+	// round-trips byte-for-byte through COPY's text format.
+	copyDataSQL := fmt.Sprintf("COPY %s (%s) TO STDOUT", table, columns)
+	if predicate != "" {
+		copyDataSQL = fmt.Sprintf("COPY (SELECT %s FROM %s WHERE %s) TO STDOUT", columns, table, predicate)
+	}
+
+	var records io.Writer = chanWriter(ch)
+	if masks := m.getColumnMasks(tableName, schema, columnNames); masks != nil {
+		records = &copyMaskWriter{w: chanWriter(ch), masks: masks}
+	}
+
+	err = m.conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+		_, err := pgConn.CopyTo(ctx, records, copyDataSQL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ch <- "\\.\n"
 	return nil
 }
+
+// getColumnNames returns the names of the table's columns that hold
+// data to be packed, i.e. every column except generated ones.
+func (m Manager) getColumnNames(tableName string, schema string) ([]string, error) {
+	rows, err := m.snapshot.Query(`
+		SELECT a.attname
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = $1
+			AND n.nspname = $2
+			AND a.attnum > 0
+			AND NOT a.attisdropped
+			AND a.attgenerated = ''
+		ORDER BY a.attnum;
+	`, tableName, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columnNames []string
+	for rows.Next() {
+		var columnName string
+		if err := rows.Scan(&columnName); err != nil {
+			return nil, err
+		}
+		columnNames = append(columnNames, columnName)
+	}
+
+	return columnNames, rows.Err()
+}
+
+// chanWriter is an io.Writer broadcasting everything written to it on a channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestColumnDefinition(t *testing.T) {
+	text := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	number := func(n int64) sql.NullInt64 { return sql.NullInt64{Int64: n, Valid: true} }
+
+	tests := []struct {
+		name   string
+		column tableColumn
+		want   string
+	}{
+		{
+			name:   "plain",
+			column: tableColumn{name: text("name"), dataType: text("text"), isNullable: text("YES"), udtName: text("text"), typeSchema: text("pg_catalog")},
+			want:   "name text",
+		},
+		{
+			name: "serial",
+			column: tableColumn{name: text("id"), dataType: text("integer"), isNullable: text("NO"), udtName: text("int4"), typeSchema: text("pg_catalog"),
+				columnDefault: text("nextval('orders_id_seq'::regclass)")},
+			want: "id integer NOT NULL DEFAULT nextval('app.orders_id_seq'::regclass)",
+		},
+		{
+			name: "numeric",
+			column: tableColumn{name: text("Price"), dataType: text("numeric"), isNullable: text("YES"), udtName: text("numeric"), typeSchema: text("pg_catalog"),
+				numericPrecision: number(10), numericScale: number(2)},
+			want: `"Price" numeric(10,2)`,
+		},
+		{
+			name: "generated",
+			column: tableColumn{name: text("total"), dataType: text("numeric"), isNullable: text("YES"), udtName: text("numeric"), typeSchema: text("pg_catalog"),
+				generationExpression: text("(price * (quantity)::numeric)")},
+			want: "total numeric GENERATED ALWAYS AS ((price * (quantity)::numeric)) STORED",
+		},
+		{
+			name:   "array of a user-defined type",
+			column: tableColumn{name: text("tags"), dataType: text("ARRAY"), isNullable: text("YES"), udtName: text("_tag"), typeSchema: text("app")},
+			want:   "tags app.tag[]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := columnDefinition("app", test.column)
+			if err != nil {
+				t.Fatalf("columnDefinition: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("columnDefinition = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   []byte
+		typeOID uint32
+		want    string
+	}{
+		{"true", []byte("t"), pgtype.BoolOID, "TRUE"},
+		{"false", []byte("f"), pgtype.BoolOID, "FALSE"},
+		{"smallint", []byte("-12"), pgtype.Int2OID, "-12"},
+		{"integer", []byte("42"), pgtype.Int4OID, "42"},
+		{"bigint", []byte("9223372036854775807"), pgtype.Int8OID, "9223372036854775807"},
+		{"oid", []byte("4294967295"), pgtype.OIDOID, "4294967295"},
+		{"real", []byte("1.5"), pgtype.Float4OID, "1.5"},
+		{"double precision", []byte("-1e-300"), pgtype.Float8OID, "-1e-300"},
+		{"real NaN", []byte("NaN"), pgtype.Float4OID, "'NaN'"},
+		{"double precision infinity", []byte("Infinity"), pgtype.Float8OID, "'Infinity'"},
+		{"double precision negative infinity", []byte("-Infinity"), pgtype.Float8OID, "'-Infinity'"},
+		{"numeric", []byte("12345.6789"), pgtype.NumericOID, "12345.6789"},
+		{"numeric NaN", []byte("NaN"), pgtype.NumericOID, "'NaN'"},
+		{"numeric infinity", []byte("Infinity"), pgtype.NumericOID, "'Infinity'"},
+		{"numeric negative infinity", []byte("-Infinity"), pgtype.NumericOID, "'-Infinity'"},
+		{"text", []byte("it's"), pgtype.TextOID, "'it''s'"},
+		{"bytea", []byte(`\xdeadbeef`), pgtype.ByteaOID, `'\xdeadbeef'`},
+		{"timestamptz", []byte("2024-02-29 23:59:59.999999+01"), pgtype.TimestamptzOID, "'2024-02-29 23:59:59.999999+01'"},
+		{"integer array", []byte("{1,NULL,3}"), pgtype.Int4ArrayOID, "'{1,NULL,3}'"},
+		{"text array", []byte(`{"a b","it's"}`), pgtype.TextArrayOID, `'{"a b","it''s"}'`},
+		{"NULL", nil, pgtype.Int4OID, "NULL"},
+		{"empty string", []byte{}, pgtype.TextOID, "''"},
+	}
+
+	for _, test := range tests {
+		if got := formatLiteral(test.value, test.typeOID); got != test.want {
+			t.Errorf("formatLiteral(%s) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
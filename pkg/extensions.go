@@ -0,0 +1,98 @@
+package core
+
+import (
+	"fmt"
+)
+
+// getExtensions returns the extensions installed in the given schemas or in
+// pg_catalog (e.g. plpgsql), along with the extensions owning their schema,
+// which they create themselves.
+func (m Manager) getExtensions(schemas []string, filter objectFilter) ([]packObject, error) {
+	rows, err := m.snapshot.Query(`
+		SELECT
+			e.oid,
+			e.extname,
+			n.nspname,
+			e.extversion,
+			EXISTS (
+				SELECT 1
+				FROM pg_catalog.pg_depend d
+				WHERE d.classid = 'pg_catalog.pg_namespace'::regclass
+					AND d.objid = e.extnamespace
+					AND d.refclassid = 'pg_catalog.pg_extension'::regclass
+					AND d.refobjid = e.oid
+					AND d.deptype = 'e'
+			) AS owns_schema
+		FROM pg_catalog.pg_extension e
+		JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+		ORDER BY e.extname;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packed := make(map[string]bool, len(schemas))
+	for _, schema := range schemas {
+		packed[schema] = true
+	}
+
+	var extensions []packObject
+	for rows.Next() {
+		var (
+			oid                   uint32
+			name, schema, version string
+			ownsSchema            bool
+		)
+		if err := rows.Scan(&oid, &name, &schema, &version, &ownsSchema); err != nil {
+			return nil, err
+		}
+
+		stmt := fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", quoteIdent(name))
+		switch {
+		case ownsSchema && filter.includesSchema(schema):
+			// The extension creates its schema as told by its control file
+		case packed[schema] || schema == "pg_catalog":
+			stmt += " WITH SCHEMA " + quoteIdent(renamedSchema(schema, m.Options.RenameSchemas))
+		default:
+			continue
+		}
+		stmt += fmt.Sprintf(" VERSION %s;", quoteLiteral(version))
+
+		extensions = append(extensions, packObject{
+			Key:       objectKey{"pg_extension", oid},
+			Type:      "EXTENSION",
+			Schema:    schema,
+			Name:      name,
+			Statement: stmt,
+		})
+	}
+
+	return extensions, rows.Err()
+}
+
+// getExtensionMembers returns the objects created by extensions. They are
+// left out of the package, as creating the extension creates them again.
+func (m Manager) getExtensionMembers() (map[objectKey]bool, error) {
+	rows, err := m.snapshot.Query(`
+		SELECT d.classid::regclass::text, d.objid
+		FROM pg_catalog.pg_depend d
+		WHERE d.refclassid = 'pg_catalog.pg_extension'::regclass
+			AND d.deptype = 'e';
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[objectKey]bool)
+	for rows.Next() {
+		var key objectKey
+		if err := rows.Scan(&key.Catalog, &key.OID); err != nil {
+			return nil, err
+		}
+		members[key] = true
+	}
+
+	return members, rows.Err()
+}
@@ -0,0 +1,406 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// relationEntryTypes lists the types of the entries concerning a relation
+// (table, view, materialized view or sequence), be it its definition, its
+// data or its constraints. Entries of these types are selected together.
+var relationEntryTypes = map[string]bool{
+	"TABLE":                  true,
+	"VIEW":                   true,
+	"MATERIALIZED VIEW":      true,
+	"SEQUENCE":               true,
+	"DROP TABLE":             true,
+	"DROP VIEW":              true,
+	"DROP MATERIALIZED VIEW": true,
+	"TABLE DATA":             true,
+	"MATERIALIZED VIEW DATA": true,
+	"SEQUENCE SET":           true,
+	"SEQUENCE OWNED BY":      true,
+	"PRIMARY KEY":            true,
+	"CONSTRAINT":             true,
+	"INDEX":                  true,
+	"FK CONSTRAINT":          true,
+}
+
+// dataEntryTypes lists the types of the entries holding data rather than DDL.
+var dataEntryTypes = map[string]bool{
+	"TABLE DATA":             true,
+	"MATERIALIZED VIEW DATA": true,
+	"SEQUENCE SET":           true,
+}
+
+// globalEntryTypes lists the types of the entries every restore needs.
+var globalEntryTypes = map[string]bool{
+	"SETTINGS":       true,
+	"SCHEMA RENAMES": true,
+}
+
+// isSelectiveRestore reports whether the options restrict which objects
+// of a package are restored.
+func (o *Options) isSelectiveRestore() bool {
+	return len(o.Schemas) > 0 || len(o.Tables) > 0 || len(o.ExcludeTables) > 0 || o.DataOnly || o.SchemaOnly
+}
+
+// namePattern selects schemas or relations by name. Patterns are either
+// globs ('*', '?' and '[...]' as in path.Match) or regular expressions
+// enclosed in slashes (e.g. '/^audit_/'). Relation globs are given as
+// 'relation' (any schema) or 'schema.relation', while relation regular
+// expressions are matched against the qualified name 'schema.relation'.
+type namePattern struct {
+	schema string // Glob the schema must match, if any
+	name   string // Glob the name must match
+	regexp *regexp.Regexp
+}
+
+// compilePatterns parses the given patterns. If qualified is set, they
+// designate relations, otherwise schemas.
+func compilePatterns(patterns []string, qualified bool) ([]namePattern, error) {
+	compiled := make([]namePattern, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			}
+			compiled = append(compiled, namePattern{regexp: re})
+			continue
+		}
+
+		p := namePattern{name: pattern}
+		if qualified {
+			if schema, name, ok := strings.Cut(pattern, "."); ok {
+				p.schema, p.name = schema, name
+			}
+		}
+
+		for _, glob := range []string{p.schema, p.name} {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			}
+		}
+
+		compiled = append(compiled, p)
+	}
+
+	return compiled, nil
+}
+
+// matches reports whether the pattern selects the relation schema.name,
+// or the schema name if schema is empty.
+func (p namePattern) matches(schema string, name string) bool {
+	if p.regexp != nil {
+		if schema != "" {
+			name = schema + "." + name
+		}
+		return p.regexp.MatchString(name)
+	}
+
+	if p.schema != "" {
+		if ok, _ := path.Match(p.schema, schema); !ok {
+			return false
+		}
+	}
+
+	ok, _ := path.Match(p.name, name)
+	return ok
+}
+
+// matchesAny reports whether any of the patterns selects the given name.
+func matchesAny(patterns []namePattern, schema string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(schema, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectFilter holds the compiled patterns of Options.
+type objectFilter struct {
+	schemas          []namePattern
+	excludeSchemas   []namePattern
+	tables           []namePattern
+	excludeTables    []namePattern
+	excludeTableData []namePattern
+}
+
+func (o *Options) compileFilter() (objectFilter, error) {
+	var (
+		f   objectFilter
+		err error
+	)
+
+	if f.schemas, err = compilePatterns(o.Schemas, false); err != nil {
+		return f, err
+	}
+	if f.excludeSchemas, err = compilePatterns(o.ExcludeSchemas, false); err != nil {
+		return f, err
+	}
+	if f.tables, err = compilePatterns(o.Tables, true); err != nil {
+		return f, err
+	}
+	if f.excludeTables, err = compilePatterns(o.ExcludeTables, true); err != nil {
+		return f, err
+	}
+	if f.excludeTableData, err = compilePatterns(o.ExcludeTableData, true); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// includesSchema reports whether objects of the schema are packed.
+func (f objectFilter) includesSchema(schema string) bool {
+	return (len(f.schemas) == 0 || matchesAny(f.schemas, "", schema)) && !matchesAny(f.excludeSchemas, "", schema)
+}
+
+// isRelation reports whether the object is a table, a view or a sequence.
+func isRelation(object packObject) bool {
+	switch object.Type {
+	case "TABLE", "VIEW", "MATERIALIZED VIEW", "SEQUENCE":
+		return true
+	}
+	return false
+}
+
+// selectObjects returns the objects to pack, keeping their order. Relations
+// are selected by the table patterns of the options. Once some relations are
+// selected explicitly, the other objects (types, functions, sequences and so
+// on) are only packed if a selected relation depends on them, so that the
+// package can be restored on its own. Excluded tables are left out no matter what.
+func (f objectFilter) selectObjects(objects []packObject) []packObject {
+	excluded := func(object packObject) bool {
+		return isRelation(object) && matchesAny(f.excludeTables, object.Schema, object.Name)
+	}
+
+	selected := make(map[objectKey]bool, len(objects))
+	for _, object := range objects {
+		if len(f.tables) == 0 || isRelation(object) && matchesAny(f.tables, object.Schema, object.Name) {
+			selected[object.Key] = true
+		}
+	}
+
+	if len(f.tables) > 0 {
+		// Dependencies always precede their dependents
+		for i := len(objects) - 1; i >= 0; i-- {
+			if !selected[objects[i].Key] {
+				continue
+			}
+			for _, dep := range objects[i].Deps {
+				selected[dep] = true
+			}
+		}
+	}
+
+	var result []packObject
+	for _, object := range objects {
+		if selected[object.Key] && !excluded(object) {
+			result = append(result, object)
+		}
+	}
+
+	return result
+}
+
+// packedSchemas returns the schemas to create in the package. Once some
+// relations are selected explicitly, only the schemas of the packed objects
+// are created.
+func (f objectFilter) packedSchemas(schemas []string, objects []packObject) []string {
+	if len(f.tables) == 0 {
+		return schemas
+	}
+
+	used := make(map[string]bool)
+	for _, object := range objects {
+		used[object.Schema] = true
+	}
+
+	var result []string
+	for _, schema := range schemas {
+		if used[schema] {
+			result = append(result, schema)
+		}
+	}
+
+	return result
+}
+
+// excludesTableData reports whether the data records of the table are left out.
+func (f objectFilter) excludesTableData(table packObject) bool {
+	return matchesAny(f.excludeTableData, table.Schema, table.Name)
+}
+
+// entrySchema returns the schema the object of an entry belongs to.
+func entrySchema(entry tocEntry) string {
+	if entry.Type == "SCHEMA" {
+		return entry.Name
+	}
+	return entry.Schema
+}
+
+// selectEntries returns the entries of an archive to restore, keeping their
+// order. Entries are selected by the schema of their object and, for
+// relations, by the name of the relation. Along with the selected objects,
+// the entries depending on them (constraints, indexes, dependent views and
+// so on) are restored, so that they are recreated after the objects are.
+// Triggers go along with the table or view they are defined on, whatever
+// their function. Excluded tables are left out no matter what.
+//
+// The objects the selected ones depend on are not followed: the schema,
+// types, functions or extensions a selected table needs must already exist
+// in the target database.
+func (o *Options) selectEntries(entries []tocEntry) ([]tocEntry, error) {
+	type relation struct{ schema, name string }
+
+	f, err := o.compileFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[int]bool)
+	relations := make(map[relation]bool)
+	relationIDs := make(map[int]relation) // Relations of the entries by ID
+
+	// relationOf returns the relation an entry is about, if any. The one of
+	// a trigger is the relation it is defined on.
+	relationOf := func(entry tocEntry) (relation, bool) {
+		if entry.Type == "TRIGGER" {
+			for _, dep := range entry.Deps {
+				if key, ok := relationIDs[dep]; ok {
+					return key, true
+				}
+			}
+			return relation{}, false
+		}
+		return relation{entry.Schema, entry.Name}, relationEntryTypes[entry.Type]
+	}
+
+	for _, entry := range entries {
+		key, isRelation := relationOf(entry)
+		if relationEntryTypes[entry.Type] {
+			relationIDs[entry.ID] = key
+		}
+
+		matches := (len(f.schemas) == 0 || matchesAny(f.schemas, "", entrySchema(entry))) &&
+			(len(f.tables) == 0 || isRelation && matchesAny(f.tables, key.schema, key.name))
+
+		// Dependencies always precede their dependents
+		for _, dep := range entry.Deps {
+			matches = matches || selected[dep] && entry.Type != "TRIGGER"
+		}
+
+		if matches || isRelation && relations[key] {
+			selected[entry.ID] = true
+			if isRelation {
+				relations[key] = true
+			}
+		}
+	}
+
+	var result []tocEntry
+	for _, entry := range entries {
+		key, isRelation := relationOf(entry)
+
+		switch {
+		case globalEntryTypes[entry.Type]:
+		case isRelation && matchesAny(f.excludeTables, key.schema, key.name):
+			continue
+		case o.DataOnly && !dataEntryTypes[entry.Type], o.SchemaOnly && dataEntryTypes[entry.Type]:
+			continue
+		case !selected[entry.ID] && !(isRelation && relations[key]):
+			// Entries preceding the definition of a relation pulled in
+			// as a dependent, e.g. the statement dropping it
+			continue
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// rowFilter restricts the data records packed for the tables matching
+// its pattern to the rows satisfying its predicate (a WHERE clause).
+type rowFilter struct {
+	pattern   namePattern
+	predicate string
+}
+
+// readConfigLines returns the lines of a configuration file, leaving out
+// blank lines and comments (lines starting with '#').
+func readConfigLines(filename string) ([]string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// getRowFilters parses the row filters of the options, given either
+// directly or through a file, as 'table: predicate'. In files, every line
+// holds a row filter while blank lines and lines starting with '#' are ignored.
+func (o *Options) getRowFilters() ([]rowFilter, error) {
+	lines := o.RowFilters
+
+	if o.RowFiltersFile != "" {
+		fileLines, err := readConfigLines(o.RowFiltersFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read row filters file: %v", err)
+		}
+		lines = append(lines, fileLines...)
+	}
+
+	var filters []rowFilter
+	for _, line := range lines {
+		table, predicate, ok := strings.Cut(line, ":")
+		table, predicate = strings.TrimSpace(table), strings.TrimSpace(predicate)
+		if !ok || table == "" || predicate == "" {
+			return nil, fmt.Errorf("invalid row filter '%s'. Use 'table: predicate'.", line)
+		}
+
+		patterns, err := compilePatterns([]string{table}, true)
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, rowFilter{pattern: patterns[0], predicate: predicate})
+	}
+
+	return filters, nil
+}
+
+// getTablePredicate returns the predicate the data records of the table
+// must satisfy, or an empty string if all of them are packed. The predicates
+// of all the row filters matching the table are combined, along with the
+// predicate selecting the records of the table in subset mode.
+func (m Manager) getTablePredicate(tableName string, schema string) string {
+	var predicates []string
+	if predicate := m.subset[relationName{schema, tableName}]; predicate != "" {
+		predicates = append(predicates, predicate)
+	}
+	for _, filter := range m.rowFilters {
+		if filter.pattern.matches(schema, tableName) {
+			predicates = append(predicates, "("+filter.predicate+")")
+		}
+	}
+
+	return strings.Join(predicates, " AND ")
+}
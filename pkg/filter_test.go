@@ -0,0 +1,115 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testEntries is the TOC of a package holding two schemas, where a view of
+// the second one depends on a table of the first one. Both of them have a
+// trigger calling a function of the second schema.
+var testEntries = []tocEntry{
+	{ID: 1, Type: "SETTINGS"},
+	{ID: 2, Type: "SCHEMA", Name: "app"},
+	{ID: 3, Type: "SCHEMA", Name: "other"},
+	{ID: 4, Type: "DROP TABLE", Schema: "app", Name: "orders"},
+	{ID: 5, Type: "DROP TABLE", Schema: "app", Name: "customers"},
+	{ID: 6, Type: "TABLE", Schema: "app", Name: "customers", Deps: []int{2}},
+	{ID: 7, Type: "TABLE", Schema: "app", Name: "orders", Deps: []int{2}},
+	{ID: 8, Type: "VIEW", Schema: "other", Name: "order_totals", Deps: []int{3, 7}},
+	{ID: 9, Type: "TABLE", Schema: "other", Name: "audit", Deps: []int{3}},
+	{ID: 10, Type: "TABLE DATA", Schema: "app", Name: "customers", Deps: []int{6}},
+	{ID: 11, Type: "TABLE DATA", Schema: "app", Name: "orders", Deps: []int{7}},
+	{ID: 12, Type: "TABLE DATA", Schema: "other", Name: "audit", Deps: []int{9}},
+	{ID: 13, Type: "INDEX", Schema: "app", Name: "orders", Deps: []int{7}},
+	{ID: 14, Type: "FK CONSTRAINT", Schema: "app", Name: "orders", Deps: []int{7}},
+	{ID: 15, Type: "FUNCTION", Schema: "other", Name: "audit()", Deps: []int{3}},
+	{ID: 16, Type: "TRIGGER", Schema: "app", Name: "orders_audit", Deps: []int{7, 15}},
+	{ID: 17, Type: "TRIGGER", Schema: "other", Name: "order_totals_insert", Deps: []int{8, 15}},
+}
+
+func TestSelectEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		want    []int
+	}{
+		{
+			name:    "table with its dependents",
+			options: Options{Tables: []string{"app.orders"}},
+			want:    []int{1, 4, 7, 8, 11, 13, 14, 16, 17},
+		},
+		{
+			name:    "table in any schema",
+			options: Options{Tables: []string{"customers"}},
+			want:    []int{1, 5, 6, 10},
+		},
+		{
+			name:    "schema",
+			options: Options{Schemas: []string{"other"}},
+			want:    []int{1, 3, 8, 9, 12, 15, 17},
+		},
+		{
+			name:    "excluded table",
+			options: Options{Tables: []string{"app.*"}, ExcludeTables: []string{"customers"}},
+			want:    []int{1, 4, 7, 8, 11, 13, 14, 16, 17},
+		},
+		{
+			name:    "excluded table with a trigger",
+			options: Options{Schemas: []string{"app"}, ExcludeTables: []string{"orders"}},
+			want:    []int{1, 2, 5, 6, 8, 10, 17},
+		},
+		{
+			name:    "regular expression",
+			options: Options{Tables: []string{"/^other\\.a/"}},
+			want:    []int{1, 9, 12},
+		},
+		{
+			name:    "data only",
+			options: Options{DataOnly: true},
+			want:    []int{1, 10, 11, 12},
+		},
+		{
+			name:    "data of a table",
+			options: Options{Tables: []string{"app.orders"}, DataOnly: true},
+			want:    []int{1, 11},
+		},
+		{
+			name:    "schema only",
+			options: Options{Schemas: []string{"app"}, SchemaOnly: true},
+			want:    []int{1, 2, 4, 5, 6, 7, 8, 13, 14, 16, 17},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := test.options.selectEntries(testEntries)
+			if err != nil {
+				t.Fatalf("selectEntries: %v", err)
+			}
+
+			var got []int
+			for _, entry := range entries {
+				got = append(got, entry.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("selected entries %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectEntriesInvalidPattern(t *testing.T) {
+	options := Options{Tables: []string{"/(/"}}
+	if _, err := options.selectEntries(testEntries); err == nil {
+		t.Errorf("selectEntries accepted an invalid pattern")
+	}
+}
+
+func TestDroppedTables(t *testing.T) {
+	got := droppedTables(testEntries)
+	want := []string{"app.orders", "app.customers"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("droppedTables = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// writeRecordsParallel writes the data records of the given tables to w,
+// dumping up to Options.Jobs tables at once. Every worker runs on its own
+// connection attached to the snapshot of the pack job. Tables are spooled
+// to temporary files next to the output file and appended to w in their
+// original order, so the package is the same as with a single job.
+//
+// Spool files of compressed packages are compressed with the codec of the
+// package, so that records are never written to disk in the clear, and
+// workers run at most twice as many tables ahead of w as there are jobs,
+// which bounds the disk space taken by the spool files.
+func (m Manager) writeRecordsParallel(w *packageWriter, tables []packObject, snapshotID string) error {
+	spoolDir, err := os.MkdirTemp(filepath.Dir(*m.OutputFilename), ".pg_pack-")
+	if err != nil {
+		return fmt.Errorf("cannot create spool directory: %v", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	window := make(chan struct{}, 2*m.Options.Jobs)
+
+	queue := make(chan int, len(tables))
+	done := make([]chan struct{}, len(tables))
+	for i := range tables {
+		queue <- i
+		done[i] = make(chan struct{})
+	}
+	close(queue)
+
+	spoolFilename := func(i int) string {
+		return filepath.Join(spoolDir, fmt.Sprintf("%d.sql", i))
+	}
+
+	for n := 0; n < m.Options.Jobs && n < len(tables); n++ {
+		g.Go(func() error {
+			worker, err := m.beginSnapshot(ctx, snapshotID)
+			if err != nil {
+				return err
+			}
+			defer worker.endSnapshot()
+
+			for {
+				select {
+				case window <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+
+				i, ok := <-queue
+				if !ok {
+					return nil
+				}
+
+				err := writeSpoolFile(w, spoolFilename(i), func(spool io.Writer) error {
+					return worker.writeTableRecords(ctx, spool, tables[i].Name, tables[i].Schema)
+				})
+				if err != nil {
+					return fmt.Errorf("error while dumping table %s.%s: %v", tables[i].Schema, tables[i].Name, err)
+				}
+
+				close(done[i])
+			}
+		})
+	}
+
+	for i := range tables {
+		select {
+		case <-done[i]:
+		case <-ctx.Done():
+			return g.Wait()
+		}
+
+		err := w.beginEntry(tableDataObject(tables[i]))
+		if err == nil {
+			err = appendSpoolFile(w, spoolFilename(i))
+		}
+		if err == nil {
+			err = w.endEntry()
+		}
+		if err != nil {
+			cancel()
+			g.Wait()
+			return err
+		}
+
+		<-window
+	}
+
+	return g.Wait()
+}
+
+// writeSpoolFile creates a spool file holding what write writes to it. The
+// spool files of archives are compressed with their codec at its fastest
+// level.
+func writeSpoolFile(w *packageWriter, filename string, write func(io.Writer) error) error {
+	spoolFile, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("cannot create spool file: %v", err)
+	}
+	defer spoolFile.Close()
+
+	if !w.archive {
+		return write(spoolFile)
+	}
+
+	compressor, err := w.codec.newWriter(spoolFile, w.codec.minLevel)
+	if err != nil {
+		return fmt.Errorf("cannot create spool file: %v", err)
+	}
+
+	if err := write(compressor); err != nil {
+		compressor.Close()
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("error while writing spool file: %v", err)
+	}
+
+	return nil
+}
+
+// appendSpoolFile copies the content of a spool file to w and removes it.
+func appendSpoolFile(w *packageWriter, filename string) error {
+	spoolFile, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open spool file: %v", err)
+	}
+	defer os.Remove(filename)
+	defer spoolFile.Close()
+
+	var spool io.Reader = spoolFile
+	if w.archive {
+		decompressor, err := w.codec.newReader(spoolFile)
+		if err != nil {
+			return fmt.Errorf("cannot read spool file: %v", err)
+		}
+		defer decompressor.Close()
+		spool = decompressor
+	}
+
+	if _, err := io.Copy(w, spool); err != nil {
+		return fmt.Errorf("error while writing data records: %v", err)
+	}
+
+	return nil
+}
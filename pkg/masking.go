@@ -0,0 +1,293 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maskingRule replaces the values of the columns matching column in the
+// tables matching pattern with the output of a transformer, so that no
+// sensitive data makes it into the package.
+type maskingRule struct {
+	pattern     namePattern
+	column      string // Glob the column must match
+	transformer string
+	argument    string
+}
+
+// maskingTransformers lists the transformers masking rules can use. They
+// are given a value and the key of the options and return the masked value.
+// NULL values are never handed over to transformers and stay NULL.
+//
+//	null          replaces values with NULL
+//	fixed <value> replaces values with <value>
+//	hash          replaces values with their HMAC-SHA256 under the masking key
+//	email         replaces values with a fake email address
+//	name          replaces values with a fake full name
+//	redact [n]    replaces every character but the last n (4 by default) with '*'
+//	token         replaces values with a token, derived from the masking key
+//
+// Transformers are deterministic: equal values are masked the same way, so
+// that masked columns can still be joined on. Apart from null and fixed,
+// transformers produce text and are meant for text columns.
+var maskingTransformers = map[string]func(value string, argument string, key []byte) *string{
+	"null": func(value string, argument string, key []byte) *string {
+		return nil
+	},
+	"fixed": func(value string, argument string, key []byte) *string {
+		return &argument
+	},
+	"hash": func(value string, argument string, key []byte) *string {
+		masked := hex.EncodeToString(maskingDigest(value, key))
+		return &masked
+	},
+	"email": func(value string, argument string, key []byte) *string {
+		masked := fmt.Sprintf("user_%s@example.com", hex.EncodeToString(maskingDigest(value, key)[:6]))
+		return &masked
+	},
+	"name": func(value string, argument string, key []byte) *string {
+		digest := maskingDigest(value, key)
+		first := fakeFirstNames[binary.BigEndian.Uint32(digest[0:4])%uint32(len(fakeFirstNames))]
+		last := fakeLastNames[binary.BigEndian.Uint32(digest[4:8])%uint32(len(fakeLastNames))]
+		masked := first + " " + last
+		return &masked
+	},
+	"redact": func(value string, argument string, key []byte) *string {
+		keep := 4
+		if argument != "" {
+			keep, _ = strconv.Atoi(argument)
+		}
+
+		runes := []rune(value)
+		for i := 0; i < len(runes)-keep; i++ {
+			runes[i] = '*'
+		}
+		masked := string(runes)
+		return &masked
+	},
+	"token": func(value string, argument string, key []byte) *string {
+		masked := "tok_" + hex.EncodeToString(maskingDigest(value, key)[:12])
+		return &masked
+	},
+}
+
+// keyedMaskingTransformers are the transformers deriving their output from a
+// digest of the value, which require a masking key.
+var keyedMaskingTransformers = map[string]bool{"hash": true, "email": true, "name": true, "token": true}
+
+var fakeFirstNames = []string{
+	"Alex", "Amelia", "Ava", "Benjamin", "Charlotte", "Daniel", "Elena", "Ethan",
+	"Grace", "Hannah", "Isaac", "Jack", "Julia", "Leo", "Lucas", "Maya",
+	"Mia", "Noah", "Nora", "Oliver", "Olivia", "Samuel", "Sara", "Zoe",
+}
+
+var fakeLastNames = []string{
+	"Adams", "Baker", "Brown", "Carter", "Clark", "Davis", "Evans", "Garcia",
+	"Hall", "Harris", "Jones", "King", "Lee", "Lopez", "Miller", "Moore",
+	"Nelson", "Parker", "Reed", "Smith", "Taylor", "Turner", "Walker", "Young",
+}
+
+// maskingDigest returns the HMAC-SHA256 of the value under the masking key.
+func maskingDigest(value string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// getMaskingRules parses the masking rules file of the options. Every line
+// holds a rule as 'schema.table.column: transformer [argument]', where the
+// schema may be left out and every part may be a glob. Blank lines and
+// lines starting with '#' are ignored.
+func (o *Options) getMaskingRules() ([]maskingRule, error) {
+	if o.MaskingRulesFile == "" {
+		return nil, nil
+	}
+
+	lines, err := readConfigLines(o.MaskingRulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read masking rules file: %v", err)
+	}
+
+	var rules []maskingRule
+	for _, line := range lines {
+		target, transformation, ok := strings.Cut(line, ":")
+		target, transformation = strings.TrimSpace(target), strings.TrimSpace(transformation)
+		dot := strings.LastIndex(target, ".")
+		if !ok || dot <= 0 || dot == len(target)-1 || transformation == "" {
+			return nil, fmt.Errorf("invalid masking rule '%s'. Use 'schema.table.column: transformer'.", line)
+		}
+		table, column := target[:dot], target[dot+1:]
+
+		if _, err := path.Match(column, ""); err != nil {
+			return nil, fmt.Errorf("invalid masking rule '%s': %v", line, err)
+		}
+
+		patterns, err := compilePatterns([]string{table}, true)
+		if err != nil {
+			return nil, err
+		}
+
+		transformer, argument, _ := strings.Cut(transformation, " ")
+		transformer, argument = strings.ToLower(transformer), strings.TrimSpace(argument)
+
+		if _, ok := maskingTransformers[transformer]; !ok {
+			return nil, fmt.Errorf("invalid masking rule '%s': unknown transformer '%s'", line, transformer)
+		}
+		if transformer == "redact" && argument != "" {
+			if n, err := strconv.Atoi(argument); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid masking rule '%s': redact takes the number of characters to keep", line)
+			}
+		}
+		if keyedMaskingTransformers[transformer] && o.MaskingKey == "" {
+			// Without a secret key, the masked values could be reversed
+			// by hashing guesses
+			return nil, fmt.Errorf("invalid masking rule '%s': %s requires a masking key", line, transformer)
+		}
+
+		rules = append(rules, maskingRule{pattern: patterns[0], column: column, transformer: transformer, argument: argument})
+	}
+
+	return rules, nil
+}
+
+// columnMask masks a value of a column. A nil result stands for NULL.
+type columnMask func(value string) *string
+
+// getColumnMasks returns the masks of the given columns of the table, nil
+// for the columns left as they are. The first rule matching a column wins.
+// It returns nil if no column of the table is masked.
+func (m Manager) getColumnMasks(tableName string, schema string, columnNames []string) []columnMask {
+	var masks []columnMask
+
+	for i, columnName := range columnNames {
+		for _, rule := range m.maskingRules {
+			if ok, _ := path.Match(rule.column, columnName); !ok || !rule.pattern.matches(schema, tableName) {
+				continue
+			}
+
+			if masks == nil {
+				masks = make([]columnMask, len(columnNames))
+			}
+
+			transform, argument, key := maskingTransformers[rule.transformer], rule.argument, []byte(m.Options.MaskingKey)
+			masks[i] = func(value string) *string {
+				return transform(value, argument, key)
+			}
+			break
+		}
+	}
+
+	return masks
+}
+
+// copyMaskWriter masks the records it is given in COPY's text format
+// before handing them over to w. Records are buffered until complete.
+type copyMaskWriter struct {
+	w       chanWriter
+	masks   []columnMask
+	pending []byte
+}
+
+func (cw *copyMaskWriter) Write(p []byte) (int, error) {
+	cw.pending = append(cw.pending, p...)
+
+	for {
+		end := bytes.IndexByte(cw.pending, '\n')
+		if end < 0 {
+			break
+		}
+
+		fields := strings.Split(string(cw.pending[:end]), "\t")
+		for i, mask := range cw.masks {
+			if mask == nil || i >= len(fields) || fields[i] == `\N` {
+				continue
+			}
+
+			masked := mask(unescapeCopyValue(fields[i]))
+			if masked == nil {
+				fields[i] = `\N`
+			} else {
+				fields[i] = escapeCopyValue(*masked)
+			}
+		}
+
+		cw.w <- strings.Join(fields, "\t") + "\n"
+		cw.pending = cw.pending[end+1:]
+	}
+
+	return len(p), nil
+}
+
+// copyEscapes maps the characters escaped in COPY's text format to their escapes.
+var copyEscapes = map[byte]byte{'\\': '\\', '\b': 'b', '\f': 'f', '\n': 'n', '\r': 'r', '\t': 't', '\v': 'v'}
+
+// unescapeCopyValue decodes a value in COPY's text format.
+func unescapeCopyValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		c := value[i]
+		switch {
+		case c >= '0' && c <= '7':
+			j := i
+			for j < len(value) && j < i+3 && value[j] >= '0' && value[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(value[i:j], 8, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		case c == 'x' && i+1 < len(value) && isHexDigit(value[i+1]):
+			j := i + 1
+			for j < len(value) && j < i+3 && isHexDigit(value[j]) {
+				j++
+			}
+			n, _ := strconv.ParseUint(value[i+1:j], 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			unescaped := c
+			for raw, escape := range copyEscapes {
+				if escape == c {
+					unescaped = raw
+				}
+			}
+			b.WriteByte(unescaped)
+		}
+	}
+
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// escapeCopyValue encodes a value in COPY's text format.
+func escapeCopyValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if escape, ok := copyEscapes[value[i]]; ok {
+			b.WriteByte('\\')
+			b.WriteByte(escape)
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
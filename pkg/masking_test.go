@@ -0,0 +1,136 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyValueEscapeRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain",
+		"tab\there",
+		"new\nline\r\n",
+		`back\slash`,
+		"\b\f\v",
+		`\N`,
+		"naïve ☃",
+		"\x00\x01",
+	}
+
+	for _, value := range values {
+		escaped := escapeCopyValue(value)
+		if strings.ContainsAny(escaped, "\t\n\r") {
+			t.Errorf("escapeCopyValue(%q) = %q holds a delimiter", value, escaped)
+		}
+		if got := unescapeCopyValue(escaped); got != value {
+			t.Errorf("unescapeCopyValue(escapeCopyValue(%q)) = %q", value, got)
+		}
+	}
+}
+
+func TestUnescapeCopyValue(t *testing.T) {
+	tests := map[string]string{
+		`a\tb`:  "a\tb",
+		`\101B`: "AB",
+		`\x41B`: "AB",
+		`\x4`:   "\x04",
+		`\xZ`:   "xZ",
+		`\q`:    "q",
+		`end\`:  `end\`,
+	}
+
+	for value, want := range tests {
+		if got := unescapeCopyValue(value); got != want {
+			t.Errorf("unescapeCopyValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestCopyMaskWriter(t *testing.T) {
+	redact := maskingTransformers["redact"]
+	masks := []columnMask{
+		nil,
+		func(value string) *string { return redact(value, "2", nil) },
+		func(value string) *string { return nil },
+	}
+
+	ch := make(chanWriter, 10)
+	w := &copyMaskWriter{w: ch, masks: masks}
+
+	// Records are split across writes on purpose
+	for _, chunk := range []string{"1\tsec", "ret\\tvalue\tx\n2\t\\N\t", "y\n"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	close(ch)
+
+	var got strings.Builder
+	for record := range ch {
+		got.WriteString(record)
+	}
+
+	want := "1\t**********ue\t\\N\n2\t\\N\t\\N\n"
+	if got.String() != want {
+		t.Errorf("masked records %q, want %q", got.String(), want)
+	}
+}
+
+func TestMaskingTransformersUseKey(t *testing.T) {
+	for _, name := range []string{"hash", "email", "name", "token"} {
+		transform := maskingTransformers[name]
+
+		a, b := transform("alice@example.org", "", []byte("key 1")), transform("alice@example.org", "", []byte("key 2"))
+		if *a == *b {
+			t.Errorf("%s masks values the same way under different keys", name)
+		}
+
+		if again := transform("alice@example.org", "", []byte("key 1")); *again != *a {
+			t.Errorf("%s is not deterministic", name)
+		}
+	}
+}
+
+func TestGetMaskingRules(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules")
+	write := func(rules string) {
+		if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# users\npublic.users.email: email\nusers.ssn: redact 4\n*.*.notes: null\n")
+	options := Options{MaskingRulesFile: rulesFile, MaskingKey: "secret"}
+	rules, err := options.getMaskingRules()
+	if err != nil {
+		t.Fatalf("getMaskingRules: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3", len(rules))
+	}
+	if rules[1].column != "ssn" || rules[1].transformer != "redact" || rules[1].argument != "4" {
+		t.Errorf("second rule is %+v", rules[1])
+	}
+
+	for _, invalid := range []string{"users: null", "public.users.email", "users.email: scramble", "users.ssn: redact x"} {
+		write(invalid)
+		if _, err := options.getMaskingRules(); err == nil {
+			t.Errorf("getMaskingRules accepted %q", invalid)
+		}
+	}
+
+	for _, keyed := range []string{"users.email: hash", "users.email: email", "users.email: name", "users.email: token"} {
+		write(keyed)
+		unkeyedOptions := Options{MaskingRulesFile: rulesFile}
+		if _, err := unkeyedOptions.getMaskingRules(); err == nil {
+			t.Errorf("getMaskingRules accepted %q without a masking key", keyed)
+		}
+
+		if _, err := options.getMaskingRules(); err != nil {
+			t.Errorf("getMaskingRules(%q): %v", keyed, err)
+		}
+	}
+}
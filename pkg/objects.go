@@ -0,0 +1,321 @@
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// objectKey identifies a database object by the system catalog
+// it is stored in (e.g. 'pg_class') and its OID within it.
+type objectKey struct {
+	Catalog string
+	OID     uint32
+}
+
+// packObject is a database object written to the package
+// along with the statements creating it.
+type packObject struct {
+	Key       objectKey
+	Type      string // e.g. "TABLE", "VIEW", "FUNCTION"
+	Schema    string
+	Name      string
+	Statement string
+	Deps      []objectKey // Objects this one depends on
+}
+
+// getDefinitions returns every object of the given schemas that must exist
+// before the data records are loaded, as selected by the filter. The objects
+// are ordered so that each of them comes after the objects it depends on,
+// whatever schema they are in.
+func (m Manager) getDefinitions(schemas []string, filter objectFilter) ([]packObject, error) {
+	// Extensions come first, as other objects may depend on the objects they create
+	objects, err := m.getExtensions(schemas, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching extensions: %v", err)
+	}
+
+	for _, schema := range schemas {
+		types, err := m.getCreateTypeStatements(schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing CREATE TYPE statement: %v", err)
+		}
+
+		domains, err := m.getDomainStatements(schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing DOMAIN statement: %v", err)
+		}
+
+		functions, err := m.getFunctionStatements(schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing FUNCTION statement: %v", err)
+		}
+
+		sequences, err := m.getSequenceStatements(schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing SEQUENCE statement: %v", err)
+		}
+
+		tables, err := m.getTables(schema, filter)
+		if err != nil {
+			return nil, fmt.Errorf("error while fetching tables: %v", err)
+		}
+
+		objects = append(objects, types...)
+		objects = append(objects, domains...)
+		objects = append(objects, functions...)
+		objects = append(objects, sequences...)
+		objects = append(objects, tables...)
+	}
+
+	views, err := m.getViews(schemas)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching views: %v", err)
+	}
+	objects = append(objects, views...)
+
+	members, err := m.getExtensionMembers()
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching extension members: %v", err)
+	}
+
+	var userObjects []packObject
+	for _, object := range objects {
+		key := object.Key
+		if object.Type == "SHELL TYPE" {
+			key = objectKey{"pg_type", key.OID}
+		}
+		if !members[key] {
+			userObjects = append(userObjects, object)
+		}
+	}
+	objects = userObjects
+
+	deps, err := m.getDependencies()
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching dependencies: %v", err)
+	}
+
+	dependOnShellTypes(objects, deps)
+
+	for i := range objects {
+		objects[i].Deps = deps[objects[i].Key]
+	}
+
+	objects = filter.selectObjects(sortByDependencies(objects, deps))
+
+	for i, object := range objects {
+		if object.Type != "TABLE" {
+			continue
+		}
+
+		objects[i].Statement, err = m.getCreateTableStatement(object.Name, object.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing CREATE statement: %v", err)
+		}
+	}
+
+	return objects, nil
+}
+
+// getDependencies returns the dependencies between user objects recorded in
+// pg_depend. Dependencies of sub-objects (rewrite rules, column defaults,
+// domain constraints) are attributed to the object owning them, and
+// dependencies on row, array and multirange types to the relation, element
+// or range type behind them. Dependencies on objects created by extensions
+// are attributed to the extension. Triggers are attributed to their table, so
+// that trigger functions are packed along with the tables using them,
+// although the triggers themselves are only created once the data records
+// are loaded (see writeTriggers). Table constraints are left out: they are
+// added after the data records are loaded, so they never dictate the order
+// of definitions.
+// This is also what breaks the cycles foreign keys would otherwise create.
+func (m Manager) getDependencies() (map[objectKey][]objectKey, error) {
+	rows, err := m.snapshot.Query(`
+		WITH owners (classid, objid, owner_classid, owner_objid) AS (
+			SELECT 'pg_catalog.pg_rewrite'::regclass, r.oid, 'pg_catalog.pg_class'::regclass, r.ev_class
+			FROM pg_catalog.pg_rewrite r
+			UNION ALL
+			SELECT 'pg_catalog.pg_attrdef'::regclass, a.oid, 'pg_catalog.pg_class'::regclass, a.adrelid
+			FROM pg_catalog.pg_attrdef a
+			UNION ALL
+			SELECT 'pg_catalog.pg_constraint'::regclass, c.oid, 'pg_catalog.pg_type'::regclass, c.contypid
+			FROM pg_catalog.pg_constraint c
+			WHERE c.contypid <> 0
+			UNION ALL
+			SELECT 'pg_catalog.pg_trigger'::regclass, t.oid, 'pg_catalog.pg_class'::regclass, t.tgrelid
+			FROM pg_catalog.pg_trigger t
+			WHERE NOT t.tgisinternal
+			UNION ALL
+			-- Row types of tables, views, ...
+			SELECT 'pg_catalog.pg_type'::regclass, t.oid, 'pg_catalog.pg_class'::regclass, t.typrelid
+			FROM pg_catalog.pg_type t
+			JOIN pg_catalog.pg_class c ON c.oid = t.typrelid
+			WHERE c.relkind <> 'c'
+			UNION ALL
+			-- Relations backing composite types
+			SELECT 'pg_catalog.pg_class'::regclass, c.oid, 'pg_catalog.pg_type'::regclass, c.reltype
+			FROM pg_catalog.pg_class c
+			WHERE c.relkind = 'c'
+			UNION ALL
+			-- Array types
+			SELECT 'pg_catalog.pg_type'::regclass, t.oid, 'pg_catalog.pg_type'::regclass, t.typelem
+			FROM pg_catalog.pg_type t
+			WHERE t.typelem <> 0 AND t.typlen = -1
+			UNION ALL
+			-- Objects created by extensions
+			SELECT d.classid::regclass, d.objid, d.refclassid::regclass, d.refobjid
+			FROM pg_catalog.pg_depend d
+			WHERE d.refclassid = 'pg_catalog.pg_extension'::regclass
+				AND d.deptype = 'e'
+			UNION ALL
+			-- Multirange types (PostgreSQL 14 and later)
+			SELECT 'pg_catalog.pg_type'::regclass, (pg_catalog.to_jsonb(r) ->> 'rngmultitypid')::oid, 'pg_catalog.pg_type'::regclass, r.rngtypid
+			FROM pg_catalog.pg_range r
+			WHERE pg_catalog.to_jsonb(r) ? 'rngmultitypid'
+		)
+		SELECT DISTINCT
+			COALESCE(o.owner_classid, d.classid)::regclass::text AS catalog,
+			COALESCE(o.owner_objid, d.objid) AS oid,
+			COALESCE(r.owner_classid, d.refclassid)::regclass::text AS ref_catalog,
+			COALESCE(r.owner_objid, d.refobjid) AS ref_oid
+		FROM pg_catalog.pg_depend d
+		LEFT JOIN owners o ON o.classid = d.classid AND o.objid = d.objid
+		LEFT JOIN owners r ON r.classid = d.refclassid AND r.objid = d.refobjid
+		WHERE d.deptype = 'n'
+			AND (d.classid <> 'pg_catalog.pg_constraint'::regclass OR o.owner_classid IS NOT NULL)
+			-- Built-in objects (below FirstNormalObjectId) are never packed
+			AND d.objid >= 16384
+			AND d.refobjid >= 16384;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := make(map[objectKey][]objectKey)
+	for rows.Next() {
+		var object, dependency objectKey
+		if err := rows.Scan(&object.Catalog, &object.OID, &dependency.Catalog, &dependency.OID); err != nil {
+			return nil, err
+		}
+
+		if object != dependency {
+			deps[object] = append(deps[object], dependency)
+		}
+	}
+
+	return deps, rows.Err()
+}
+
+// dependOnShellTypes breaks the cycles between base types and their I/O
+// functions, which depend on each other: deps is changed so that the
+// functions depend on the shell types of the given objects instead, which
+// are created ahead of the base types.
+func dependOnShellTypes(objects []packObject, deps map[objectKey][]objectKey) {
+	for _, object := range objects {
+		if object.Type != "SHELL TYPE" {
+			continue
+		}
+
+		baseType := objectKey{"pg_type", object.Key.OID}
+		for _, function := range deps[baseType] {
+			for i, dep := range deps[function] {
+				if dep == baseType {
+					deps[function][i] = object.Key
+				}
+			}
+		}
+	}
+}
+
+// sortByDependencies orders the objects so that each of them comes after the
+// objects it depends on. Dependencies on objects outside of the given ones
+// are ignored and the original order is kept wherever the dependencies allow
+// it. Should the dependencies form a cycle, it is broken arbitrarily.
+func sortByDependencies(objects []packObject, deps map[objectKey][]objectKey) []packObject {
+	index := make(map[objectKey]int, len(objects))
+	for i, object := range objects {
+		index[object.Key] = i
+	}
+
+	visited := make([]bool, len(objects))
+	sorted := make([]packObject, 0, len(objects))
+
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+
+		for _, dep := range deps[objects[i].Key] {
+			if j, ok := index[dep]; ok {
+				visit(j)
+			}
+		}
+		sorted = append(sorted, objects[i])
+	}
+
+	for i := range objects {
+		visit(i)
+	}
+
+	return sorted
+}
+
+// filterObjects returns the objects of the given types, keeping their order.
+func filterObjects(objects []packObject, types ...string) []packObject {
+	var filtered []packObject
+	for _, object := range objects {
+		for _, t := range types {
+			if object.Type == t {
+				filtered = append(filtered, object)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// writeDrops writes the statements dropping the packed tables and views
+// to w, in reverse order of their definitions so that dependent objects
+// are dropped first.
+func writeDrops(w *packageWriter, objects []packObject) error {
+	_, err := io.WriteString(w, "\n-- START OF DROPPING TABLES\n")
+	if err != nil {
+		return fmt.Errorf("error while writing DROP statement: %v", err)
+	}
+
+	relations := filterObjects(objects, "TABLE", "VIEW", "MATERIALIZED VIEW")
+	for i := len(relations) - 1; i >= 0; i-- {
+		relation := relations[i]
+		object := packObject{Type: "DROP " + relation.Type, Schema: relation.Schema, Name: relation.Name}
+		err = w.writeEntry(object, fmt.Sprintf("DROP %s IF EXISTS %s;\n", relation.Type, qualifiedName(relation.Schema, relation.Name)))
+		if err != nil {
+			return fmt.Errorf("error while writing DROP statement: %v", err)
+		}
+	}
+
+	_, err = io.WriteString(w, "-- END OF DROPPING TABLES\n")
+	return err
+}
+
+// writeDefinitions writes the statements creating the objects to w.
+func writeDefinitions(w *packageWriter, objects []packObject) error {
+	_, err := io.WriteString(w, "\n-- START OF DEFINITIONS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing CREATE statement: %v", err)
+	}
+
+	for _, object := range objects {
+		io.WriteString(w, fmt.Sprintf("\n-- %s: %s\n", object.Type, commentText(object.Schema+"."+object.Name)))
+
+		err = w.writeEntry(object, object.Statement+"\n")
+		if err != nil {
+			return fmt.Errorf("error while writing %s statement: %v", object.Type, err)
+		}
+	}
+
+	_, err = io.WriteString(w, "-- END OF DEFINITIONS\n")
+	return err
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+// objectNames returns the qualified names of the objects, in order.
+func objectNames(objects []packObject) []string {
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.Schema+"."+object.Name)
+	}
+	return names
+}
+
+func TestSortByDependencies(t *testing.T) {
+	status := packObject{Key: objectKey{"pg_type", 1}, Type: "TYPE", Schema: "app", Name: "status"}
+	orders := packObject{Key: objectKey{"pg_class", 2}, Type: "TABLE", Schema: "sales", Name: "orders"}
+	totals := packObject{Key: objectKey{"pg_class", 3}, Type: "VIEW", Schema: "app", Name: "totals"}
+	audit := packObject{Key: objectKey{"pg_class", 4}, Type: "TABLE", Schema: "app", Name: "audit"}
+
+	deps := map[objectKey][]objectKey{
+		orders.Key: {status.Key, {"pg_namespace", 5}}, // The schema is not packed
+		totals.Key: {orders.Key},
+	}
+
+	// Schemas are fetched one after the other, so the view comes first
+	got := objectNames(sortByDependencies([]packObject{totals, status, audit, orders}, deps))
+	want := []string{"app.status", "sales.orders", "app.totals", "app.audit"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sorted objects %v, want %v", got, want)
+	}
+}
+
+func TestSortByDependenciesCycle(t *testing.T) {
+	a := packObject{Key: objectKey{"pg_class", 1}, Schema: "app", Name: "a"}
+	b := packObject{Key: objectKey{"pg_class", 2}, Schema: "app", Name: "b"}
+	c := packObject{Key: objectKey{"pg_class", 3}, Schema: "app", Name: "c"}
+
+	deps := map[objectKey][]objectKey{
+		a.Key: {b.Key},
+		b.Key: {a.Key},
+		c.Key: {b.Key},
+	}
+
+	got := objectNames(sortByDependencies([]packObject{c, a, b}, deps))
+	want := []string{"app.a", "app.b", "app.c"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sorted objects %v, want %v", got, want)
+	}
+}
+
+func TestDependOnShellTypes(t *testing.T) {
+	baseType := packObject{Key: objectKey{"pg_type", 1}, Type: "TYPE", Schema: "app", Name: "point3"}
+	shellType := packObject{Key: shellTypeKey(1), Type: "SHELL TYPE", Schema: "app", Name: "point3"}
+	input := packObject{Key: objectKey{"pg_proc", 2}, Type: "FUNCTION", Schema: "app", Name: "point3_in(cstring)"}
+	output := packObject{Key: objectKey{"pg_proc", 3}, Type: "FUNCTION", Schema: "app", Name: "point3_out(app.point3)"}
+
+	deps := map[objectKey][]objectKey{
+		baseType.Key: {input.Key, output.Key},
+		input.Key:    {baseType.Key},
+		output.Key:   {baseType.Key, {"pg_namespace", 4}},
+	}
+
+	objects := []packObject{baseType, shellType, input, output}
+	dependOnShellTypes(objects, deps)
+
+	for _, function := range []packObject{input, output} {
+		if deps[function.Key][0] != shellType.Key {
+			t.Errorf("%s depends on %v, want the shell type", function.Name, deps[function.Key])
+		}
+	}
+	if fmt.Sprint(deps[baseType.Key]) != fmt.Sprint([]objectKey{input.Key, output.Key}) {
+		t.Errorf("base type depends on %v, want its I/O functions", deps[baseType.Key])
+	}
+
+	var got []string
+	for _, object := range sortByDependencies(objects, deps) {
+		got = append(got, object.Type+" "+object.Name)
+	}
+	want := []string{"SHELL TYPE point3", "FUNCTION point3_in(cstring)", "FUNCTION point3_out(app.point3)", "TYPE point3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sorted objects %v, want %v", got, want)
+	}
+}
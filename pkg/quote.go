@@ -0,0 +1,75 @@
+package core
+
+import "strings"
+
+// sqlKeywords lists the keywords of PostgreSQL that cannot be used as bare
+// identifiers everywhere: the reserved keywords along with the keywords
+// restricted to type, function or column names.
+var sqlKeywords = func() map[string]bool {
+	keywords := make(map[string]bool)
+	for _, keyword := range strings.Fields(`
+		all analyse analyze and any array as asc asymmetric authorization between
+		bigint binary bit boolean both case cast char character check coalesce
+		collate collation column concurrently constraint create cross
+		current_catalog current_date current_role current_schema current_time
+		current_timestamp current_user dec decimal default deferrable desc
+		distinct do else end except exists extract false fetch float for foreign
+		freeze from full grant greatest group grouping having ilike in initially
+		inner inout int integer intersect interval into is isnull join json
+		json_array json_arrayagg json_exists json_object json_objectagg
+		json_query json_scalar json_serialize json_table json_value lateral
+		leading least left like limit localtime localtimestamp merge_action
+		national natural nchar none normalize not notnull null nullif numeric
+		offset on only or order out outer overlaps overlay placing position
+		precision primary real references returning right row select
+		session_user setof similar smallint some substring symmetric
+		system_user table tablesample then time timestamp to trailing treat
+		trim true union unique user using values varchar variadic verbose
+		when where window with xmlattributes xmlconcat xmlelement xmlexists
+		xmlforest xmlnamespaces xmlparse xmlpi xmlroot xmlserialize xmltable
+	`) {
+		keywords[keyword] = true
+	}
+	return keywords
+}()
+
+// quoteIdent returns the name as an SQL identifier, quoted only if needed,
+// like the quote_ident function of PostgreSQL does.
+func quoteIdent(name string) string {
+	safe := name != "" && !sqlKeywords[name] && !(name[0] >= '0' && name[0] <= '9')
+	for i := 0; safe && i < len(name); i++ {
+		c := name[i]
+		safe = c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+	}
+
+	if safe {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteIdents quotes every name of a list of identifiers.
+func quoteIdents(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return quoted
+}
+
+// qualifiedName returns the quoted, schema-qualified name of an object.
+func qualifiedName(schema string, name string) string {
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+// commentText returns the text with its line breaks replaced by spaces, so
+// that it can be written into an SQL comment, like pg_dump does with names.
+func commentText(text string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+}
+
+// quoteLiteral returns the value as a string literal. Backslashes are taken
+// literally, as packages turn standard_conforming_strings on.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
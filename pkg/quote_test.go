@@ -0,0 +1,55 @@
+package core
+
+import "testing"
+
+func TestQuoteIdent(t *testing.T) {
+	tests := map[string]string{
+		"orders":      "orders",
+		"order_items": "order_items",
+		"_t1":         "_t1",
+		"Orders":      `"Orders"`,
+		"order items": `"order items"`,
+		"1st":         `"1st"`,
+		"select":      `"select"`,
+		"user":        `"user"`,
+		"name":        "name",
+		"café":        `"café"`,
+		`a"b`:         `"a""b"`,
+		"a\nb":        "\"a\nb\"",
+		"":            `""`,
+	}
+
+	for name, want := range tests {
+		if got := quoteIdent(name); got != want {
+			t.Errorf("quoteIdent(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	if got, want := qualifiedName("Sales", "order"), `"Sales"."order"`; got != want {
+		t.Errorf("qualifiedName = %s, want %s", got, want)
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := map[string]string{
+		"plain":   "'plain'",
+		"it's":    "'it''s'",
+		`back\sl`: `'back\sl'`,
+		"":        "''",
+	}
+
+	for value, want := range tests {
+		if got := quoteLiteral(value); got != want {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestCommentText(t *testing.T) {
+	name := qualifiedName("public", "t\nDROP TABLE users; --\r\nx")
+	if got, want := commentText(name), `public."t DROP TABLE users; -- x"`; got != want {
+		t.Errorf("commentText(%q) = %q, want %q", name, got, want)
+	}
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxIdentifierLength is the length (in bytes) past which PostgreSQL
+// truncates identifiers.
+const maxIdentifierLength = 63
+
+// schemaRenameStash is the prefix of the name a pre-existing schema is
+// moved to while another one is restored under its name.
+const schemaRenameStash = "_pg_pack_"
+
+// renamedSchema returns the name a schema gets as given by renames.
+func renamedSchema(schema string, renames map[string]string) string {
+	if newName, ok := renames[schema]; ok {
+		return newName
+	}
+	return schema
+}
+
+// packedObjectNames returns the names of the given objects by schema. The
+// names of functions are given without their arguments.
+func packedObjectNames(objects []packObject) map[string]map[string]bool {
+	names := make(map[string]map[string]bool)
+	for _, object := range objects {
+		name := object.Name
+		if object.Key.Catalog == "pg_proc" {
+			name, _, _ = strings.Cut(name, "(")
+		}
+		if names[object.Schema] == nil {
+			names[object.Schema] = make(map[string]bool)
+		}
+		names[object.Schema][name] = true
+	}
+	return names
+}
+
+// renameSchemaReferences returns the SQL with the schema names qualifying
+// the names of packed objects it references (e.g. 'public.orders') replaced
+// as given by renames, along with the ones of names given as string literals
+// cast to regclass (e.g. in nextval('public.orders_id_seq'::regclass)).
+// packed gives the names of the packed objects by schema, see
+// packedObjectNames: since a table name may also qualify a column name (e.g.
+// 'sales.amount'), only the names followed by a packed object of the schema
+// are replaced. Comments, other literals and dollar-quoted strings, such as
+// function bodies, are left untouched.
+func renameSchemaReferences(sql string, renames map[string]string, packed map[string]map[string]bool) string {
+	if len(renames) == 0 {
+		return sql
+	}
+
+	var (
+		b    strings.Builder
+		last byte // Last byte written outside of spaces and comments
+	)
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		start := i
+
+		switch {
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			i = strings.IndexByte(sql[i:], '\n')
+			if i < 0 {
+				i = len(sql)
+			} else {
+				i += start
+			}
+			b.WriteString(sql[start:i])
+			continue
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth, i = depth+1, i+2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth, i = depth-1, i+2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			b.WriteString(sql[start:i])
+			continue
+
+		case c == '\'':
+			escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isIdentifierByte(sql[i-2]))
+			for i++; i < len(sql); i++ {
+				if escapes && sql[i] == '\\' {
+					i++
+				} else if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			i = min(i+1, len(sql))
+
+			literal := sql[start:i]
+			if !escapes && strings.HasPrefix(sql[i:], "::regclass") && len(literal) >= 2 && literal[len(literal)-1] == '\'' {
+				name := strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+				literal = quoteLiteral(renameSchemaReferences(name, renames, packed))
+			}
+			b.WriteString(literal)
+
+		case c == '$' && (i == 0 || !isIdentifierByte(sql[i-1])):
+			tag := dollarTag(sql[i:])
+			if tag == "" {
+				i++
+				b.WriteByte(c)
+				break
+			}
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			b.WriteString(sql[start:i])
+
+		case c == '"' || isIdentifierByte(c) && !(c >= '0' && c <= '9'):
+			var name string
+			name, i = scanIdentifier(sql, i)
+
+			// Only the first part of a qualified name is a schema
+			newName, ok := renames[name]
+			if ok && last != '.' && i < len(sql) && sql[i] == '.' {
+				if object, _ := scanIdentifier(sql, i+1); packed[name][object] {
+					b.WriteString(quoteIdent(newName))
+					break
+				}
+			}
+			b.WriteString(sql[start:i])
+
+		case c >= '0' && c <= '9':
+			for i < len(sql) && (isIdentifierByte(sql[i]) || sql[i] == '$') {
+				i++
+			}
+			b.WriteString(sql[start:i])
+
+		default:
+			i++
+			b.WriteByte(c)
+			if isSpace(c) {
+				continue
+			}
+		}
+
+		last = sql[i-1]
+	}
+
+	return b.String()
+}
+
+// scanIdentifier returns the name of the identifier sql holds at i, quoted
+// or not, along with the offset of its end. Unquoted names are folded to
+// lower case. The name is empty if there is no identifier at i.
+func scanIdentifier(sql string, i int) (name string, end int) {
+	start := i
+	if i < len(sql) && sql[i] == '"' {
+		for i++; i < len(sql); i++ {
+			if sql[i] == '"' {
+				if i+1 < len(sql) && sql[i+1] == '"' {
+					i++
+					continue
+				}
+				break
+			}
+		}
+		i = min(i+1, len(sql))
+		if quoted := sql[start:i]; len(quoted) >= 2 && quoted[len(quoted)-1] == '"' {
+			name = strings.ReplaceAll(quoted[1:len(quoted)-1], `""`, `"`)
+		}
+		return name, i
+	}
+
+	if i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+		return "", i
+	}
+	for i < len(sql) && (isIdentifierByte(sql[i]) || sql[i] == '$') {
+		i++
+	}
+	return strings.ToLower(sql[start:i]), i
+}
+
+// dollarTag returns the tag opening the dollar-quoted string s starts with
+// (e.g. '$_$'), or an empty string if s does not start with one.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		}
+		if !isIdentifierByte(c) || (i == 1 && c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ""
+}
+
+// schemaRenameStatements returns the statements wrapping a package so that
+// its schemas are restored under new names, as given by renames (old name to
+// new name). Instead of rewriting every definition of the package, the
+// prologue lends the new schema the old name for the duration of the restore
+// (moving a pre-existing schema with the old name out of the way) and the
+// epilogue gives both schemas their final names back. Since PostgreSQL tracks
+// references between objects by OID, views, constraints, defaults and so on
+// follow the rename. Function bodies are plain text and are left untouched.
+//
+// The schemas are renamed in place, so the statements must run in the same
+// transaction as the package, as Restore does. Names that PostgreSQL would
+// truncate are rejected, as truncated names could collide.
+func schemaRenameStatements(renames map[string]string) (prologue string, epilogue string, err error) {
+	if len(renames) == 0 {
+		return "", "", nil
+	}
+
+	oldNames := make([]string, 0, len(renames))
+	for oldName := range renames {
+		oldNames = append(oldNames, oldName)
+	}
+	sort.Strings(oldNames)
+
+	var before, after []string
+	for _, oldName := range oldNames {
+		newName := renames[oldName]
+		stash := schemaRenameStash + oldName
+
+		if len(stash) > maxIdentifierLength {
+			return "", "", fmt.Errorf("cannot rename schema '%s': its name is longer than %d bytes", oldName, maxIdentifierLength-len(schemaRenameStash))
+		}
+		if len(newName) > maxIdentifierLength {
+			return "", "", fmt.Errorf("cannot rename schema '%s' to '%s': the new name is longer than %d bytes", oldName, newName, maxIdentifierLength)
+		}
+
+		before = append(before,
+			renameSchemaIfExists(oldName, stash),
+			renameSchemaIfExists(newName, oldName))
+		after = append(after,
+			renameSchemaIfExists(oldName, newName),
+			renameSchemaIfExists(stash, oldName))
+	}
+
+	prologue = "\n-- START OF SCHEMA RENAMES\n" + strings.Join(before, "\n") + "\n-- END OF SCHEMA RENAMES\n"
+	epilogue = "\n-- START OF SCHEMA RENAMES\n" + strings.Join(after, "\n") + "\n-- END OF SCHEMA RENAMES\n"
+
+	return prologue, epilogue, nil
+}
+
+// renameSchemaIfExists returns a statement renaming a schema, if it exists.
+func renameSchemaIfExists(from string, to string) string {
+	return fmt.Sprintf(`DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_catalog.pg_namespace WHERE nspname = %s) THEN
+		ALTER SCHEMA %s RENAME TO %s;
+	END IF;
+END $$;`, quoteLiteral(from), quoteIdent(from), quoteIdent(to))
+}
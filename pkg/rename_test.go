@@ -0,0 +1,56 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenameSchemaReferences(t *testing.T) {
+	renames := map[string]string{"public": "staging", "Sales": "sales 2", "sales": "archive"}
+	packed := packedObjectNames([]packObject{
+		{Key: objectKey{"pg_class", 1}, Schema: "public", Name: "orders"},
+		{Key: objectKey{"pg_class", 2}, Schema: "public", Name: "customers"},
+		{Key: objectKey{"pg_class", 3}, Schema: "public", Name: "s"},
+		{Key: objectKey{"pg_class", 4}, Schema: "public", Name: "orders_id_seq"},
+		{Key: objectKey{"pg_proc", 5}, Schema: "public", Name: "f(integer)"},
+		{Key: objectKey{"pg_class", 6}, Schema: "Sales", Name: "orders"},
+		{Key: objectKey{"pg_class", 7}, Schema: "sales", Name: "sales"},
+	})
+
+	tests := []struct {
+		sql, want string
+	}{
+		{"CREATE TABLE public.orders (id integer);", "CREATE TABLE staging.orders (id integer);"},
+		{`ALTER TABLE "Sales".orders ADD FOREIGN KEY (c) REFERENCES public.customers(id);`, `ALTER TABLE "sales 2".orders ADD FOREIGN KEY (c) REFERENCES staging.customers(id);`},
+		{"ALTER SEQUENCE public.s OWNED BY public.orders.id;", "ALTER SEQUENCE staging.s OWNED BY staging.orders.id;"},
+		{"id integer DEFAULT nextval('public.orders_id_seq'::regclass)", "id integer DEFAULT nextval('staging.orders_id_seq'::regclass)"},
+		{"SELECT 'public.orders', E'public.x', \"public\"", "SELECT 'public.orders', E'public.x', \"public\""},
+		{"-- public.orders\n/* public.x /* public.y */ */ SELECT 1.5", "-- public.orders\n/* public.x /* public.y */ */ SELECT 1.5"},
+		{"AS $f$ SELECT public.f() $f$;", "AS $f$ SELECT public.f() $f$;"},
+		{"SELECT x.public.y, $1", "SELECT x.public.y, $1"},
+		{"SELECT public FROM other.public", "SELECT public FROM other.public"},
+		{"SELECT public.f(1), public.g(1) FROM public.other", "SELECT staging.f(1), public.g(1) FROM public.other"},
+		{"SELECT sales.amount FROM sales.sales", "SELECT sales.amount FROM archive.sales"},
+		{`SELECT "Sales"."orders", "Sales"."Orders"`, `SELECT "sales 2"."orders", "Sales"."Orders"`},
+	}
+
+	for _, test := range tests {
+		if got := renameSchemaReferences(test.sql, renames, packed); got != test.want {
+			t.Errorf("renameSchemaReferences(%q) = %q, want %q", test.sql, got, test.want)
+		}
+	}
+}
+
+func TestSchemaRenameStatementsRejectsLongNames(t *testing.T) {
+	if _, _, err := schemaRenameStatements(map[string]string{"public": "staging"}); err != nil {
+		t.Fatalf("schemaRenameStatements: %v", err)
+	}
+
+	long := strings.Repeat("s", maxIdentifierLength-len(schemaRenameStash)+1)
+	if _, _, err := schemaRenameStatements(map[string]string{long: "staging"}); err == nil {
+		t.Errorf("schemaRenameStatements accepted a schema whose stash name would be truncated")
+	}
+	if _, _, err := schemaRenameStatements(map[string]string{"public": strings.Repeat("s", maxIdentifierLength+1)}); err == nil {
+		t.Errorf("schemaRenameStatements accepted a new name that would be truncated")
+	}
+}
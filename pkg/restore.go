@@ -0,0 +1,541 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// maxBatchSize is the approximate amount of SQL (in bytes) that Restore
+// buffers before sending the pending statements to the server.
+const maxBatchSize = 1 << 20
+
+// Restore replays a package created by Pack against the database.
+// Plain '.sql' packages are read as-is while compressed '.pack' packages
+// are decompressed on the fly, whichever codec they were compressed with.
+// Regular statements are sent to the server in batches and the data of
+// 'COPY ... FROM stdin' blocks is streamed through the COPY protocol. The
+// whole package is restored inside a single transaction, so a failed
+// restore leaves no trace behind. Schemas listed in Options.RenameSchemas
+// are restored under their new names. Compressed packages can also be
+// restored partially, see selectEntries.
+func (m Manager) Restore(inputFilename string) error {
+	inputFile, err := os.Open(inputFilename)
+	if err != nil {
+		return fmt.Errorf("cannot open input file: %v", err)
+	}
+	defer inputFile.Close()
+
+	if m.Options.DataOnly && m.Options.SchemaOnly {
+		return fmt.Errorf("data-only and schema-only modes cannot be used together.")
+	}
+
+	script, entries, err := m.openPackage(inputFile)
+	if err != nil {
+		return fmt.Errorf("cannot read package: %v", err)
+	}
+	defer script.Close()
+
+	ctx := context.Background()
+
+	conn, err := m.Database.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error while connecting to the database: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+
+		if _, err := pgConn.Exec(ctx, "BEGIN").ReadAll(); err != nil {
+			return fmt.Errorf("cannot start restore transaction: %v", err)
+		}
+
+		rollback := func(err error) error {
+			pgConn.Exec(ctx, "ROLLBACK").ReadAll()
+			return err
+		}
+
+		prologue, epilogue, err := schemaRenameStatements(m.Options.RenameSchemas)
+		if err != nil {
+			return rollback(err)
+		}
+		if err := replayScript(ctx, pgConn, newScriptReader(strings.NewReader(prologue))); err != nil {
+			return rollback(err)
+		}
+
+		// Foreign keys of the database referencing the tables the package
+		// drops would make dropping them fail, so they are set aside while
+		// the tables are restored and added back (and checked) afterwards
+		dropKeys, addKeys, err := referencingForeignKeys(ctx, pgConn, droppedTables(entries))
+		if err != nil {
+			return rollback(fmt.Errorf("error while fetching foreign keys referencing restored tables: %v", err))
+		}
+
+		for _, script := range []*scriptReader{
+			newScriptReader(strings.NewReader(dropKeys)),
+			newScriptReader(script),
+		} {
+			if err := replayScript(ctx, pgConn, script); err != nil {
+				return rollback(err)
+			}
+		}
+
+		if err := replayScript(ctx, pgConn, newScriptReader(strings.NewReader(addKeys))); err != nil {
+			return rollback(fmt.Errorf("cannot add back foreign keys referencing restored tables: %v", err))
+		}
+
+		if err := replayScript(ctx, pgConn, newScriptReader(strings.NewReader(epilogue))); err != nil {
+			return rollback(err)
+		}
+
+		if _, err := pgConn.Exec(ctx, "COMMIT").ReadAll(); err != nil {
+			return fmt.Errorf("cannot commit restore transaction: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// openPackage returns a reader over the SQL script stored in the package,
+// along with the entries to restore for archives. Packages starting with
+// the pg_pack header are plain scripts, archives are replayed entry by entry
+// and single-stream packages (format version 1) name their codec in their
+// header. Anything else is treated as a brotli-compressed package written
+// before codecs were recorded.
+func (m Manager) openPackage(f *os.File) (io.ReadCloser, []tocEntry, error) {
+	reader := bufio.NewReader(f)
+
+	head, err := reader.Peek(len(packageHeader))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	hasMagic := len(head) >= len(packMagic)+2 && string(head[:len(packMagic)]) == packMagic
+	isArchive := hasMagic && head[len(packMagic)] > 1
+
+	if !isArchive && m.Options.isSelectiveRestore() {
+		return nil, nil, fmt.Errorf("only compressed packages (.pack) can be restored selectively, pack the database with --compress to restore parts of it")
+	}
+
+	if string(head) == packageHeader {
+		return io.NopCloser(reader), nil, nil
+	}
+
+	if !hasMagic {
+		return io.NopCloser(brotli.NewReader(reader)), nil, nil
+	}
+
+	if !isArchive {
+		codec, err := getCompressionCodecByID(head[len(packMagic)+1])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader.Discard(len(packMagic) + 2)
+
+		script, err := codec.newReader(reader)
+		return script, nil, err
+	}
+
+	archive, err := openArchive(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := archive.entries
+	if m.Options.isSelectiveRestore() {
+		entries, err = m.Options.selectEntries(entries)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return io.NopCloser(archive.script(entries)), entries, nil
+}
+
+// droppedTables returns the qualified names of the tables dropped by the
+// given entries of a package.
+func droppedTables(entries []tocEntry) []string {
+	var tables []string
+	for _, entry := range entries {
+		if entry.Type == "DROP TABLE" {
+			tables = append(tables, qualifiedName(entry.Schema, entry.Name))
+		}
+	}
+	return tables
+}
+
+// referencingForeignKeys returns the statements dropping the foreign keys of
+// the database that reference the given tables from other tables, and the
+// statements adding back those declared on tables other than the given ones.
+// Tables missing from the database are ignored.
+func referencingForeignKeys(ctx context.Context, pgConn *pgconn.PgConn, tables []string) (drop string, add string, err error) {
+	if len(tables) == 0 {
+		return "", "", nil
+	}
+
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = quoteLiteral(table)
+	}
+
+	// With an empty search_path, constraint definitions are fully qualified.
+	// conparentid is missing from servers older than PostgreSQL 11, so it is
+	// read through to_jsonb: constraints inherited by partitions go along
+	// with the constraints of their partitioned tables.
+	results, err := pgConn.Exec(ctx, `SELECT pg_catalog.set_config('search_path', '', true);
+		SELECT
+			pg_catalog.quote_ident(n.nspname) || '.' || pg_catalog.quote_ident(r.relname),
+			pg_catalog.quote_ident(c.conname),
+			pg_catalog.pg_get_constraintdef(c.oid),
+			c.conrelid = ANY(d.oids)
+		FROM pg_catalog.pg_constraint c
+		JOIN pg_catalog.pg_class r ON r.oid = c.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = r.relnamespace
+		CROSS JOIN (
+			SELECT pg_catalog.array_agg(pg_catalog.to_regclass(name)::oid) AS oids
+			FROM pg_catalog.unnest(ARRAY[`+strings.Join(names, ", ")+`]::text[]) AS name
+		) d
+		WHERE c.contype = 'f'
+			AND c.confrelid = ANY(d.oids)
+			AND c.conrelid <> c.confrelid
+			AND COALESCE((pg_catalog.to_jsonb(c) ->> 'conparentid')::oid, 0) = 0
+		ORDER BY 1, 2;`).ReadAll()
+	if err != nil {
+		return "", "", err
+	}
+
+	var drops, adds []string
+	for _, row := range results[len(results)-1].Rows {
+		table, constraint, definition, dropped := string(row[0]), string(row[1]), string(row[2]), string(row[3]) == "t"
+
+		drops = append(drops, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", table, constraint))
+		if !dropped {
+			adds = append(adds, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s;", table, constraint, definition))
+		}
+	}
+
+	return strings.Join(drops, "\n"), strings.Join(adds, "\n"), nil
+}
+
+// replayScript executes every statement of the script on the given connection.
+func replayScript(ctx context.Context, pgConn *pgconn.PgConn, script *scriptReader) error {
+	var batch strings.Builder
+	batchLine := 0
+
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+
+		if _, err := pgConn.Exec(ctx, batch.String()).ReadAll(); err != nil {
+			return fmt.Errorf("error while executing statements starting at line %d: %v", batchLine, err)
+		}
+		batch.Reset()
+
+		return nil
+	}
+
+	for {
+		stmt, err := script.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading package: %v", err)
+		}
+
+		if stmt.isCopyFromStdin() {
+			if err := flush(); err != nil {
+				return err
+			}
+
+			data, err := script.copyData()
+			if err != nil {
+				return fmt.Errorf("error while reading COPY data at line %d: %v", stmt.line, err)
+			}
+
+			if _, err := pgConn.CopyFrom(ctx, data, stmt.text); err != nil {
+				return fmt.Errorf("error while copying data records at line %d: %v", stmt.line, err)
+			}
+			continue
+		}
+
+		if batch.Len() == 0 {
+			batchLine = stmt.line
+		}
+		batch.WriteString(stmt.text)
+		batch.WriteByte('\n')
+
+		if batch.Len() >= maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// scriptStatement is a single SQL statement read from a package.
+type scriptStatement struct {
+	text  string
+	line  int // Line of the script the statement starts on
+	start int // Offset of the first non-comment token in text
+}
+
+// isCopyFromStdin reports whether the statement is a 'COPY ... FROM stdin'
+// statement, i.e. whether it is followed by a block of data lines.
+func (s scriptStatement) isCopyFromStdin() bool {
+	stmt := strings.ToUpper(s.text[s.start:])
+	return strings.HasPrefix(stmt, "COPY ") && strings.Contains(stmt, "FROM STDIN")
+}
+
+// Lexer states of scriptReader.
+const (
+	lexNormal = iota
+	lexLineComment
+	lexBlockComment
+	lexString
+	lexEscapeString
+	lexIdentifier
+	lexDollarQuote
+)
+
+// scriptReader splits a SQL script into statements. It is aware of
+// comments, quoted strings and identifiers as well as dollar-quoted
+// function bodies, so semicolons inside them do not end a statement.
+type scriptReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newScriptReader(r io.Reader) *scriptReader {
+	return &scriptReader{r: bufio.NewReaderSize(r, 64*1024), line: 1}
+}
+
+func (s *scriptReader) readByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == nil && c == '\n' {
+		s.line++
+	}
+	return c, err
+}
+
+// peekByte returns the next byte of the script without consuming it.
+func (s *scriptReader) peekByte() byte {
+	b, err := s.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// next returns the next statement of the script including its terminating
+// semicolon. Comments preceding a statement are kept as part of it.
+// It returns io.EOF once no statements are left.
+func (s *scriptReader) next() (scriptStatement, error) {
+	var (
+		buf        []byte
+		stmt       = scriptStatement{start: -1}
+		state      = lexNormal
+		depth      int
+		dollarTag  []byte
+		dollarBody int
+	)
+
+	for {
+		c, err := s.readByte()
+		if err == io.EOF {
+			if stmt.start == -1 && state == lexBlockComment {
+				return scriptStatement{}, fmt.Errorf("unterminated comment at the end of the script")
+			}
+			if stmt.start == -1 {
+				return scriptStatement{}, io.EOF
+			}
+			if state != lexNormal && state != lexLineComment {
+				return scriptStatement{}, fmt.Errorf("unterminated statement starting at line %d", stmt.line)
+			}
+			stmt.text = string(buf)
+			return stmt, nil
+		}
+		if err != nil {
+			return scriptStatement{}, err
+		}
+		buf = append(buf, c)
+
+		switch state {
+		case lexNormal:
+			if c == '-' && s.peekByte() == '-' {
+				state = lexLineComment
+				continue
+			}
+			if c == '/' && s.peekByte() == '*' {
+				c, _ = s.readByte()
+				buf = append(buf, c)
+				state, depth = lexBlockComment, 1
+				continue
+			}
+
+			if stmt.start == -1 && !isSpace(c) {
+				stmt.start, stmt.line = len(buf)-1, s.line
+			}
+
+			switch c {
+			case '\'':
+				state = lexString
+				if n := len(buf); n >= 2 && (buf[n-2] == 'E' || buf[n-2] == 'e') && (n == 2 || !isIdentifierByte(buf[n-3])) {
+					state = lexEscapeString
+				}
+			case '"':
+				state = lexIdentifier
+			case '$':
+				if n := len(buf); n >= 2 && isIdentifierByte(buf[n-2]) {
+					continue
+				}
+				if tag := s.peekDollarTag(); tag != nil {
+					s.r.Discard(len(tag) - 1)
+					buf = append(buf, tag[1:]...)
+					state, dollarTag, dollarBody = lexDollarQuote, tag, len(buf)
+				}
+			case ';':
+				stmt.text = string(buf)
+				return stmt, nil
+			}
+
+		case lexLineComment:
+			if c == '\n' {
+				state = lexNormal
+			}
+
+		case lexBlockComment:
+			if c == '*' && s.peekByte() == '/' {
+				c, _ = s.readByte()
+				buf = append(buf, c)
+				if depth--; depth == 0 {
+					state = lexNormal
+				}
+			} else if c == '/' && s.peekByte() == '*' {
+				c, _ = s.readByte()
+				buf = append(buf, c)
+				depth++
+			}
+
+		case lexString:
+			if c == '\'' {
+				state = lexNormal
+			}
+
+		case lexEscapeString:
+			if c == '\\' {
+				c, err = s.readByte()
+				if err != nil {
+					continue
+				}
+				buf = append(buf, c)
+			} else if c == '\'' {
+				state = lexNormal
+			}
+
+		case lexIdentifier:
+			if c == '"' {
+				state = lexNormal
+			}
+
+		case lexDollarQuote:
+			if c == '$' && len(buf)-dollarBody >= len(dollarTag) && bytes.HasSuffix(buf, dollarTag) {
+				state = lexNormal
+			}
+		}
+	}
+}
+
+// peekDollarTag checks whether the '$' that was just read opens a
+// dollar-quoted string and, if so, returns the complete tag (e.g. '$_$').
+func (s *scriptReader) peekDollarTag() []byte {
+	ahead, _ := s.r.Peek(64)
+
+	for i, c := range ahead {
+		if c == '$' {
+			return append([]byte{'$'}, ahead[:i+1]...)
+		}
+		if !isIdentifierByte(c) || (i == 0 && c >= '0' && c <= '9') {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// copyData returns a reader over the data lines following a
+// 'COPY ... FROM stdin' statement. The reader stops at the '\.' line.
+func (s *scriptReader) copyData() (io.Reader, error) {
+	// Skip the remainder of the line holding the COPY statement
+	rest, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	s.line++
+
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected content after COPY statement: %q", rest)
+	}
+
+	return &copyDataReader{s: s}, nil
+}
+
+// copyDataReader streams the data block of a 'COPY ... FROM stdin'
+// statement, excluding its '\.' terminator line.
+type copyDataReader struct {
+	s       *scriptReader
+	pending []byte
+	done    bool
+}
+
+func (c *copyDataReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		line, err := c.s.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		c.s.line++
+
+		if trimmed := bytes.TrimRight(line, "\r\n"); string(trimmed) == `\.` {
+			c.done = true
+			continue
+		}
+
+		if err == io.EOF {
+			return 0, fmt.Errorf("unterminated COPY data")
+		}
+
+		c.pending = line
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
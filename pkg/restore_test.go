@@ -0,0 +1,160 @@
+package core
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// readStatements returns the statements of a script, trimmed, along with the
+// data of its COPY blocks.
+func readStatements(t *testing.T, script string) (statements []string, copyData []string) {
+	t.Helper()
+
+	s := newScriptReader(strings.NewReader(script))
+	for {
+		stmt, err := s.next()
+		if err == io.EOF {
+			return statements, copyData
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		statements = append(statements, strings.TrimSpace(stmt.text))
+
+		if stmt.isCopyFromStdin() {
+			data, err := s.copyData()
+			if err != nil {
+				t.Fatalf("copyData: %v", err)
+			}
+			b, err := io.ReadAll(data)
+			if err != nil {
+				t.Fatalf("reading COPY data: %v", err)
+			}
+			copyData = append(copyData, string(b))
+		}
+	}
+}
+
+func TestScriptReaderStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "plain statements",
+			script: "SELECT 1;\nSELECT 2;",
+			want:   []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name:   "strings",
+			script: "SELECT 'a;b', 'it''s;';\nSELECT 2;",
+			want:   []string{"SELECT 'a;b', 'it''s;';", "SELECT 2;"},
+		},
+		{
+			name:   "escape strings",
+			script: `SELECT E'a\';b', e'\\';` + "\nSELECT 2;",
+			want:   []string{`SELECT E'a\';b', e'\\';`, "SELECT 2;"},
+		},
+		{
+			name:   "backslashes in standard strings",
+			script: `SELECT 'a\';` + "\nSELECT 2;",
+			want:   []string{`SELECT 'a\';`, "SELECT 2;"},
+		},
+		{
+			name:   "identifiers",
+			script: `SELECT 1 AS "a;b";`,
+			want:   []string{`SELECT 1 AS "a;b";`},
+		},
+		{
+			name:   "dollar quotes",
+			script: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\nSELECT 2;",
+			want:   []string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;", "SELECT 2;"},
+		},
+		{
+			name:   "tagged dollar quotes",
+			script: "DO $body$ BEGIN PERFORM $$;$$; END $body$;\nSELECT 2;",
+			want:   []string{"DO $body$ BEGIN PERFORM $$;$$; END $body$;", "SELECT 2;"},
+		},
+		{
+			name:   "parameters and identifiers with dollars",
+			script: "PREPARE p AS SELECT $1, a$b FROM t;\nSELECT 2;",
+			want:   []string{"PREPARE p AS SELECT $1, a$b FROM t;", "SELECT 2;"},
+		},
+		{
+			name:   "line comments",
+			script: "-- a comment; with a semicolon\nSELECT 1; -- trailing;\nSELECT 2;",
+			want:   []string{"-- a comment; with a semicolon\nSELECT 1;", "-- trailing;\nSELECT 2;"},
+		},
+		{
+			name:   "nested block comments",
+			script: "/* outer; /* inner; */ still; */ SELECT 1;\nSELECT 2;",
+			want:   []string{"/* outer; /* inner; */ still; */ SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name:   "trailing statement without semicolon",
+			script: "SELECT 1;\nSELECT 2",
+			want:   []string{"SELECT 1;", "SELECT 2"},
+		},
+		{
+			name:   "trailing comment",
+			script: "SELECT 1;\n-- the end\n",
+			want:   []string{"SELECT 1;"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := readStatements(t, test.script)
+			if strings.Join(got, "\n|\n") != strings.Join(test.want, "\n|\n") {
+				t.Errorf("got statements %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScriptReaderCopyBlocks(t *testing.T) {
+	script := "COPY public.t (a, b) FROM stdin;\n" +
+		"1\tx;y\n" +
+		"2\t\\N\n" +
+		"\\.\n" +
+		"SELECT 'after';\n" +
+		"copy public.u (a) from STDIN;\n" +
+		"\\.\n"
+
+	statements, copyData := readStatements(t, script)
+
+	wantStatements := []string{"COPY public.t (a, b) FROM stdin;", "SELECT 'after';", "copy public.u (a) from STDIN;"}
+	if strings.Join(statements, "|") != strings.Join(wantStatements, "|") {
+		t.Errorf("got statements %q, want %q", statements, wantStatements)
+	}
+
+	wantData := []string{"1\tx;y\n2\t\\N\n", ""}
+	if strings.Join(copyData, "|") != strings.Join(wantData, "|") {
+		t.Errorf("got COPY data %q, want %q", copyData, wantData)
+	}
+}
+
+func TestScriptReaderLines(t *testing.T) {
+	s := newScriptReader(strings.NewReader("SELECT 1;\n\n-- comment\nSELECT\n2;\n"))
+
+	for _, want := range []int{1, 4} {
+		stmt, err := s.next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if stmt.line != want {
+			t.Errorf("statement %q starts on line %d, want %d", stmt.text, stmt.line, want)
+		}
+	}
+}
+
+func TestScriptReaderUnterminated(t *testing.T) {
+	for _, script := range []string{"SELECT 'a;", "SELECT $$ a;", "/* a; SELECT 1;", `SELECT "a;`} {
+		s := newScriptReader(strings.NewReader(script))
+		if _, err := s.next(); err == nil || err == io.EOF {
+			t.Errorf("next(%q) = %v, want an error", script, err)
+		}
+	}
+}
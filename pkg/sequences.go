@@ -0,0 +1,124 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// objectOIDs returns the OIDs of the given objects.
+func objectOIDs(objects []packObject) []uint32 {
+	oids := make([]uint32, 0, len(objects))
+	for _, object := range objects {
+		oids = append(oids, object.Key.OID)
+	}
+	return oids
+}
+
+// writeSequenceOwnerships writes the statements tying the given sequences to
+// the columns owning them (e.g. serial columns) to w. Only columns of the
+// given tables are considered, as the others are not part of the package.
+func (m Manager) writeSequenceOwnerships(w *packageWriter, sequences []packObject, tables []packObject) error {
+	rows, err := m.snapshot.Query(`
+		SELECT
+			s.oid,
+			sn.nspname,
+			s.relname,
+			t.oid,
+			tn.nspname,
+			t.relname,
+			a.attname
+		FROM pg_catalog.pg_depend d
+		JOIN pg_catalog.pg_class s ON s.oid = d.objid
+		JOIN pg_catalog.pg_namespace sn ON sn.oid = s.relnamespace
+		JOIN pg_catalog.pg_class t ON t.oid = d.refobjid
+		JOIN pg_catalog.pg_namespace tn ON tn.oid = t.relnamespace
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		WHERE d.classid = 'pg_catalog.pg_class'::regclass
+			AND d.refclassid = 'pg_catalog.pg_class'::regclass
+			AND d.deptype = 'a'
+			AND s.relkind = 'S'
+			AND s.oid = ANY($1)
+			AND t.oid = ANY($2)
+		ORDER BY sn.nspname, s.relname;
+	`, objectOIDs(sequences), objectOIDs(tables))
+	if err != nil {
+		return fmt.Errorf("error while fetching sequence ownerships: %v", err)
+	}
+	defer rows.Close()
+
+	_, err = io.WriteString(w, "\n-- START OF SEQUENCE OWNERSHIPS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing OWNED BY statement: %v", err)
+	}
+
+	for rows.Next() {
+		var (
+			sequenceOID, tableOID                                            uint32
+			sequenceSchema, sequenceName, tableSchema, tableName, columnName string
+		)
+		if err := rows.Scan(&sequenceOID, &sequenceSchema, &sequenceName, &tableOID, &tableSchema, &tableName, &columnName); err != nil {
+			return fmt.Errorf("error while fetching sequence ownerships: %v", err)
+		}
+
+		object := packObject{
+			Type:   "SEQUENCE OWNED BY",
+			Schema: sequenceSchema,
+			Name:   sequenceName,
+			Deps:   []objectKey{{"pg_class", sequenceOID}, {"pg_class", tableOID}},
+		}
+		err = w.writeEntry(object, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s;\n",
+			qualifiedName(sequenceSchema, sequenceName), qualifiedName(tableSchema, tableName), quoteIdent(columnName)))
+		if err != nil {
+			return fmt.Errorf("error while writing OWNED BY statement: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error while fetching sequence ownerships: %v", err)
+	}
+
+	_, err = io.WriteString(w, "-- END OF SEQUENCE OWNERSHIPS\n")
+	return err
+}
+
+// writeSequenceValues writes the statements restoring the current position
+// of the given sequences to w. It belongs after the data records are loaded,
+// so that nextval does not hand out values already taken by the records.
+// Positions are read from the sequences themselves rather than from
+// pg_sequences, which hides them from roles lacking the privileges to read
+// them instead of failing.
+func (m Manager) writeSequenceValues(w *packageWriter, sequences []packObject) error {
+	sorted := append([]packObject(nil), sequences...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Schema != sorted[j].Schema {
+			return sorted[i].Schema < sorted[j].Schema
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	_, err := io.WriteString(w, "\n-- START OF SEQUENCE VALUES\n")
+	if err != nil {
+		return fmt.Errorf("error while writing SETVAL statement: %v", err)
+	}
+
+	for _, seq := range sorted {
+		var (
+			value    int64
+			isCalled bool
+		)
+		err := m.snapshot.QueryRow(fmt.Sprintf("SELECT last_value, is_called FROM %s;", qualifiedName(seq.Schema, seq.Name))).Scan(&value, &isCalled)
+		if err != nil {
+			return fmt.Errorf("error while fetching the value of sequence %s.%s: %v", seq.Schema, seq.Name, err)
+		}
+
+		object := packObject{Type: "SEQUENCE SET", Schema: seq.Schema, Name: seq.Name, Deps: []objectKey{seq.Key}}
+		sequence := quoteLiteral(qualifiedName(renamedSchema(seq.Schema, m.Options.RenameSchemas), seq.Name))
+		err = w.writeEntry(object, fmt.Sprintf("SELECT pg_catalog.setval(%s, %d, %t);\n", sequence, value, isCalled))
+		if err != nil {
+			return fmt.Errorf("error while writing SETVAL statement: %v", err)
+		}
+	}
+
+	_, err = io.WriteString(w, "-- END OF SEQUENCE VALUES\n")
+	return err
+}
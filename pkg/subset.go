@@ -0,0 +1,255 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// relationName identifies a relation by its schema and name.
+type relationName struct {
+	schema string
+	name   string
+}
+
+// foreignKey is a foreign key constraint of a child table referencing
+// the columns of a parent table.
+type foreignKey struct {
+	child         objectKey
+	parent        objectKey
+	childColumns  []string
+	parentColumns []string
+}
+
+// isSubset reports whether the options pack a subset of the data records.
+func (o *Options) isSubset() bool {
+	return o.SubsetTable != ""
+}
+
+// getForeignKeys returns the foreign keys between the given tables.
+func (m Manager) getForeignKeys(tables []packObject) ([]foreignKey, error) {
+	rows, err := m.snapshot.Query(`
+		SELECT
+			c.oid,
+			c.conrelid,
+			c.confrelid,
+			ca.attname,
+			pa.attname
+		FROM pg_catalog.pg_constraint c
+		CROSS JOIN LATERAL pg_catalog.unnest(c.conkey, c.confkey) WITH ORDINALITY AS k(childnum, parentnum, position)
+		JOIN pg_catalog.pg_attribute ca ON ca.attrelid = c.conrelid AND ca.attnum = k.childnum
+		JOIN pg_catalog.pg_attribute pa ON pa.attrelid = c.confrelid AND pa.attnum = k.parentnum
+		WHERE c.contype = 'f'
+			AND c.conrelid = ANY($1)
+			AND c.confrelid = ANY($1)
+		ORDER BY c.conname, c.oid, k.position;
+	`, objectOIDs(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		foreignKeys []foreignKey
+		lastOID     uint32
+	)
+	for rows.Next() {
+		var (
+			oid, childOID, parentOID  uint32
+			childColumn, parentColumn string
+		)
+		if err := rows.Scan(&oid, &childOID, &parentOID, &childColumn, &parentColumn); err != nil {
+			return nil, err
+		}
+
+		if len(foreignKeys) == 0 || oid != lastOID {
+			foreignKeys = append(foreignKeys, foreignKey{
+				child:  objectKey{"pg_class", childOID},
+				parent: objectKey{"pg_class", parentOID},
+			})
+			lastOID = oid
+		}
+
+		fk := &foreignKeys[len(foreignKeys)-1]
+		fk.childColumns = append(fk.childColumns, childColumn)
+		fk.parentColumns = append(fk.parentColumns, parentColumn)
+	}
+
+	return foreignKeys, rows.Err()
+}
+
+// getSubset returns the predicates selecting the data records to pack in
+// subset mode, by table. Tables missing from the result get no records.
+//
+// The records of the root table are selected by the subset filter and
+// sample size. Foreign keys are then followed from the root table up to the
+// tables it references, directly or not, which get the records referenced by
+// the selected records only, so that every foreign key holds once restored.
+// As the package is read in a single snapshot, the selection is expressed
+// with subqueries rather than by collecting keys.
+//
+// Tables referencing themselves also get the records referenced by their
+// selected records, collected by a recursive query. Tables taking part in a
+// cycle of foreign keys with other tables cannot be narrowed down this way.
+// They are packed with all their records, and so are the tables they
+// reference, unless the cycle goes through the root table, which fails.
+func (m Manager) getSubset(tables []packObject) (map[relationName]string, error) {
+	patterns, err := compilePatterns([]string{m.Options.SubsetTable}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []packObject
+	for _, table := range tables {
+		if patterns[0].matches(table.Schema, table.Name) {
+			roots = append(roots, table)
+		}
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("subset table '%s' must match exactly one packed table, it matches %d", m.Options.SubsetTable, len(roots))
+	}
+	root := roots[0]
+
+	foreignKeys, err := m.getForeignKeys(tables)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching foreign keys: %v", err)
+	}
+
+	byKey := make(map[objectKey]packObject, len(tables))
+	for _, table := range tables {
+		byKey[table.Key] = table
+	}
+
+	parents := make(map[objectKey][]objectKey)
+	selfReferences := make(map[objectKey][]foreignKey)
+	for _, fk := range foreignKeys {
+		if fk.child == fk.parent {
+			selfReferences[fk.child] = append(selfReferences[fk.child], fk)
+			continue
+		}
+		parents[fk.child] = append(parents[fk.child], fk.parent)
+	}
+
+	// reachable returns the tables referenced by the given ones, directly or not
+	reachable := func(from []objectKey) map[objectKey]bool {
+		seen := make(map[objectKey]bool)
+		queue := append([]objectKey(nil), from...)
+		for len(queue) > 0 {
+			key := queue[0]
+			queue = queue[1:]
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			queue = append(queue, parents[key]...)
+		}
+		return seen
+	}
+
+	included := reachable([]objectKey{root.Key})
+
+	var cyclic []objectKey
+	for key := range included {
+		if reachable(parents[key])[key] {
+			cyclic = append(cyclic, key)
+		}
+	}
+	complete := reachable(cyclic)
+	if complete[root.Key] {
+		return nil, fmt.Errorf("subset table '%s' takes part in a cycle of foreign keys with other tables, which subset mode cannot follow", m.Options.SubsetTable)
+	}
+
+	rootPredicate := ""
+	if m.Options.SubsetFilter != "" {
+		rootPredicate = "(" + m.Options.SubsetFilter + ")"
+	}
+	if m.Options.SubsetSize > 0 {
+		// Ordering by ctid keeps the sample stable across the subqueries
+		sample := fmt.Sprintf("SELECT ctid FROM %s", qualifiedName(root.Schema, root.Name))
+		if rootPredicate != "" {
+			sample += " WHERE " + rootPredicate
+		}
+		rootPredicate = fmt.Sprintf("ctid IN (%s ORDER BY ctid LIMIT %d)", sample, m.Options.SubsetSize)
+	}
+
+	predicates := make(map[objectKey]string)
+
+	var predicate func(key objectKey) string
+	predicate = func(key objectKey) string {
+		if p, ok := predicates[key]; ok {
+			return p
+		}
+
+		var p string
+		switch {
+		case key == root.Key:
+			p = rootPredicate
+		case complete[key]:
+		default:
+			// Tables outside of cycles are only referenced by the root
+			// table and the tables it references, none of them cyclic
+			var referenced []string
+			for _, fk := range foreignKeys {
+				if fk.parent != key || fk.child == key || !included[fk.child] {
+					continue
+				}
+
+				child := byKey[fk.child]
+				selection := fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoteIdents(fk.childColumns), ", "), qualifiedName(child.Schema, child.Name))
+				if childPredicate := predicate(fk.child); childPredicate != "" {
+					selection += " WHERE " + childPredicate
+				}
+				referenced = append(referenced, fmt.Sprintf("(%s) IN (%s)", strings.Join(quoteIdents(fk.parentColumns), ", "), selection))
+			}
+			p = "(" + strings.Join(referenced, " OR ") + ")"
+		}
+
+		if fks := selfReferences[key]; p != "" && len(fks) > 0 {
+			p = selfReferenceClosure(byKey[key], p, fks)
+		}
+
+		predicates[key] = p
+		return p
+	}
+
+	subset := make(map[relationName]string, len(included))
+	for key := range included {
+		table := byKey[key]
+		subset[relationName{table.Schema, table.Name}] = predicate(key)
+	}
+
+	return subset, nil
+}
+
+// selfReferenceClosure returns the predicate selecting the records of a table
+// matching the given predicate, along with the records they reference through
+// the foreign keys of the table to itself, directly or not.
+func selfReferenceClosure(table packObject, predicate string, foreignKeys []foreignKey) string {
+	var (
+		columns []string
+		seen    = make(map[string]bool)
+		joins   []string
+	)
+	for _, fk := range foreignKeys {
+		for _, column := range fk.childColumns {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, quoteIdent(column))
+			}
+		}
+
+		referencing := make([]string, len(fk.childColumns))
+		referenced := make([]string, len(fk.parentColumns))
+		for i := range fk.childColumns {
+			referencing[i] = "s." + quoteIdent(fk.childColumns[i])
+			referenced[i] = "t." + quoteIdent(fk.parentColumns[i])
+		}
+		joins = append(joins, fmt.Sprintf("(%s) = (%s)", strings.Join(referenced, ", "), strings.Join(referencing, ", ")))
+	}
+
+	name := qualifiedName(table.Schema, table.Name)
+	return fmt.Sprintf(
+		"ctid IN (WITH RECURSIVE s AS (SELECT ctid, %s FROM %s WHERE %s UNION SELECT t.ctid, t.%s FROM %s t JOIN s ON %s) SELECT ctid FROM s)",
+		strings.Join(columns, ", "), name, predicate,
+		strings.Join(columns, ", t."), name, strings.Join(joins, " OR "),
+	)
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// writeTriggers writes the statements creating the triggers of the given
+// relations (tables, or views for INSTEAD OF triggers) to w, along with the statements restoring their firing mode when
+// it is not the default. Internal triggers (e.g. the ones enforcing foreign
+// keys) are created along with their constraint and left out.
+func (m Manager) writeTriggers(w *packageWriter, relations []packObject) error {
+	rows, err := m.snapshot.Query(`
+		SELECT
+			c.oid,
+			n.nspname,
+			c.relname,
+			t.tgname,
+			pg_catalog.pg_get_triggerdef(t.oid) AS definition,
+			t.tgenabled::text AS enabled,
+			t.tgfoid
+		FROM pg_catalog.pg_trigger t
+		JOIN pg_catalog.pg_class c ON c.oid = t.tgrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal
+			AND c.oid = ANY($1)
+		ORDER BY n.nspname, c.relname, t.tgname;
+	`, objectOIDs(relations))
+	if err != nil {
+		return fmt.Errorf("error while fetching triggers: %v", err)
+	}
+	defer rows.Close()
+
+	_, err = io.WriteString(w, "\n-- START OF TRIGGERS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing TRIGGER statement: %v", err)
+	}
+
+	for rows.Next() {
+		var (
+			tableOID, functionOID                        uint32
+			schema, tableName, name, definition, enabled string
+		)
+		if err := rows.Scan(&tableOID, &schema, &tableName, &name, &definition, &enabled, &functionOID); err != nil {
+			return fmt.Errorf("error while fetching triggers: %v", err)
+		}
+
+		stmt := definition + ";\n"
+		switch enabled {
+		case "D":
+			stmt += fmt.Sprintf("ALTER TABLE %s DISABLE TRIGGER %s;\n", qualifiedName(schema, tableName), quoteIdent(name))
+		case "R":
+			stmt += fmt.Sprintf("ALTER TABLE %s ENABLE REPLICA TRIGGER %s;\n", qualifiedName(schema, tableName), quoteIdent(name))
+		case "A":
+			stmt += fmt.Sprintf("ALTER TABLE %s ENABLE ALWAYS TRIGGER %s;\n", qualifiedName(schema, tableName), quoteIdent(name))
+		}
+
+		io.WriteString(w, fmt.Sprintf("\n-- TRIGGER: %s\tTable: %s\n", commentText(quoteIdent(name)), commentText(qualifiedName(schema, tableName))))
+
+		object := packObject{
+			Type:   "TRIGGER",
+			Schema: schema,
+			Name:   name,
+			Deps:   []objectKey{{"pg_class", tableOID}, {"pg_proc", functionOID}},
+		}
+		if err := w.writeEntry(object, stmt); err != nil {
+			return fmt.Errorf("error while writing TRIGGER statement: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error while fetching triggers: %v", err)
+	}
+
+	_, err = io.WriteString(w, "-- END OF TRIGGERS\n")
+	return err
+}
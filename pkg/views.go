@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// getViews returns the views and materialized views of the given schemas.
+// Materialized views are created empty along with their indexes, their
+// data is loaded by writeViewRefreshes.
+func (m Manager) getViews(schemas []string) ([]packObject, error) {
+	rows, err := m.snapshot.Query(`
+		SELECT
+			c.oid,
+			n.nspname,
+			c.relname,
+			c.relkind = 'm' AS materialized,
+			pg_catalog.pg_get_viewdef(c.oid, true) AS definition,
+			COALESCE(pg_catalog.array_to_string(c.reloptions, ', '), '') AS options,
+			pg_catalog.pg_get_userbyid(c.relowner) AS owner
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm')
+			AND n.nspname = ANY($1)
+		ORDER BY n.nspname, c.relname;
+	`, schemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []packObject
+	for rows.Next() {
+		var (
+			oid          uint32
+			schema       string
+			name         string
+			materialized bool
+			definition   string
+			options      string
+			owner        string
+		)
+		if err := rows.Scan(&oid, &schema, &name, &materialized, &definition, &options, &owner); err != nil {
+			return nil, err
+		}
+
+		kind := "VIEW"
+		if materialized {
+			kind = "MATERIALIZED VIEW"
+		}
+
+		stmt := fmt.Sprintf("CREATE %s %s", kind, qualifiedName(schema, name))
+		if options != "" {
+			stmt += fmt.Sprintf(" WITH (%s)", options)
+		}
+		stmt += fmt.Sprintf(" AS\n%s", strings.TrimSuffix(strings.TrimSpace(definition), ";"))
+		if materialized {
+			stmt += "\n  WITH NO DATA"
+		}
+		stmt += ";\n"
+		stmt += fmt.Sprintf("\nALTER %s %s OWNER TO %s;", kind, qualifiedName(schema, name), quoteIdent(owner))
+
+		views = append(views, packObject{
+			Key:       objectKey{"pg_class", oid},
+			Type:      kind,
+			Schema:    schema,
+			Name:      name,
+			Statement: stmt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, v := range views {
+		if v.Type != "MATERIALIZED VIEW" {
+			continue
+		}
+
+		indexStmt, err := m.getIndexStatements(v.Name, v.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("error while constructing INDEX statement: %v", err)
+		}
+		if indexStmt != "" {
+			views[i].Statement += "\n\n" + indexStmt
+		}
+	}
+
+	return views, nil
+}
+
+// writeViewRefreshes writes a REFRESH statement for every materialized
+// view to w. It belongs after the data records are loaded.
+func writeViewRefreshes(w *packageWriter, objects []packObject) error {
+	_, err := io.WriteString(w, "\n-- START OF REFRESHING MATERIALIZED VIEWS\n")
+	if err != nil {
+		return fmt.Errorf("error while writing REFRESH statement: %v", err)
+	}
+
+	for _, v := range filterObjects(objects, "MATERIALIZED VIEW") {
+		object := packObject{Type: "MATERIALIZED VIEW DATA", Schema: v.Schema, Name: v.Name, Deps: []objectKey{v.Key}}
+		err = w.writeEntry(object, fmt.Sprintf("REFRESH MATERIALIZED VIEW %s;\n", qualifiedName(v.Schema, v.Name)))
+		if err != nil {
+			return fmt.Errorf("error while writing REFRESH statement: %v", err)
+		}
+	}
+
+	_, err = io.WriteString(w, "-- END OF REFRESHING MATERIALIZED VIEWS\n")
+	return err
+}